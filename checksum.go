@@ -0,0 +1,202 @@
+package multipartdownloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const maxChecksumFileSize = 8 << 20
+
+// Expected digest of a file
+type Checksum struct {
+	Algorithm string  // As known by Verify, such as "sha256"
+	Digest string     // In hexadecimal
+}
+
+var (
+	// BSD style, as written by "sha256sum --tag" or openssl: SHA256 (file) = digest
+	bsdChecksumLine = regexp.MustCompile(`^([A-Za-z0-9-]+) ?\((.*)\) ?= ?([0-9A-Fa-f]+)$`)
+	// GNU style, as written by sha256sum: digest, two spaces or a space and a *, file
+	gnuChecksumLine = regexp.MustCompile(`^\\?([0-9A-Fa-f]+) [ *](.+)$`)
+	hexDigest = regexp.MustCompile(`^[0-9A-Fa-f]+$`)
+)
+
+// Algorithms detected from the name of checksum files, such as SHA256SUMS or file.md5
+var checksumFileAlgorithms = []struct {
+	pattern string
+	algorithm string
+	token bool     // Only a whole word of the name, alone or followed by "sum" or "sums", as in B2SUMS
+} {
+	{"sha512", "sha512", false},
+	{"sha256", "sha256", false},
+	{"sha1", "sha1", false},
+	{"md5", "md5", false},
+	{"b2", "blake2b", true},
+	{"blake2", "blake2b", false},
+}
+
+// Algorithm of a checksum file given its name, "" if the name doesn't tell
+func checksumFileAlgorithm(checksumFilename string) string {
+	lowerName := strings.ToLower(path.Base(checksumFilename))
+	words := strings.FieldsFunc(lowerName, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, a := range checksumFileAlgorithms {
+		if !a.token {
+			if strings.Contains(lowerName, a.pattern) {
+				return a.algorithm
+			}
+			continue
+		}
+		for _, word := range words {
+			if word == a.pattern || word == a.pattern + "sum" || word == a.pattern + "sums" {
+				return a.algorithm
+			}
+		}
+	}
+	return ""
+}
+
+// Algorithm of a digest given its length, when there is nothing better to go by
+func algorithmForDigest(digest string) string {
+	switch len(digest) {
+	case 32:
+		return "md5"
+	case 40:
+		return "sha1"
+	case 64:
+		return "sha256"
+	case 128:
+		return "sha512"
+	}
+	return ""
+}
+
+// Find the digest of a file in a checksum file
+//
+// GNU (sha256sum), BSD (sha256sum --tag) and bare digest formats are understood. The line
+// is chosen by the base name of the file, any of the given names. The algorithm is taken
+// from the BSD tag, or else from the name of the checksum file (such as SHA256SUMS or
+// file.sha512), or else from the length of the digest.
+func ParseChecksums(data []byte, checksumFilename string, filenames ...string) (*Checksum, error) {
+	fileAlgorithm := checksumFileAlgorithm(checksumFilename)
+	matches := func(name string) bool {
+		name = path.Base(strings.Replace(name, "\\", "/", -1))
+		for _, filename := range filenames {
+			if filename != "" && name == path.Base(filename) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var bare []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, maxChecksumFileSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if m := bsdChecksumLine.FindStringSubmatch(line); m != nil {
+			if matches(m[2]) {
+				return &Checksum{normalizeAlgorithm(m[1]), strings.ToLower(m[3])}, nil
+			}
+			continue
+		}
+		if m := gnuChecksumLine.FindStringSubmatch(line); m != nil {
+			if matches(m[2]) {
+				return newChecksum(fileAlgorithm, m[1])
+			}
+			continue
+		}
+		if hexDigest.MatchString(line) {
+			bare = append(bare, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	// A lone digest is the digest of whatever file it comes with
+	if len(bare) == 1 {
+		return newChecksum(fileAlgorithm, bare[0])
+	}
+	return nil, fmt.Errorf("No checksum for %s in %s", strings.Join(filenames, ", "), checksumFilename)
+}
+
+// Internal: build a checksum, deciding the algorithm from the digest if unknown
+func newChecksum(algorithm string, digest string) (*Checksum, error) {
+	if algorithm == "" {
+		algorithm = algorithmForDigest(digest)
+		if algorithm == "" {
+			return nil, fmt.Errorf("Unknown algorithm for a %d digits digest", len(digest))
+		}
+	}
+	return &Checksum{algorithm, strings.ToLower(digest)}, nil
+}
+
+// Get the expected digest of the file from a checksum file, at a local path or an HTTP URL
+//
+// The line of the file is chosen by the name of the file at its sources, see ParseChecksums,
+// so GatherInfo has to be called first. The algorithm of the checksum is also hashed while
+// downloading, as if set by WithHashes.
+func (dldr *MultiDownloader) LoadChecksum(location string) (*Checksum, error) {
+	var data []byte
+	var err error
+	checksumFilename := location
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		checksumFilename = urlToFilename(location)
+		data, err = dldr.fetchChecksums(location)
+	} else {
+		data, err = ioutil.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	filenames := []string{dldr.filename}
+	for _, url := range dldr.urls {
+		filenames = append(filenames, urlToFilename(url))
+	}
+	checksum, err := ParseChecksums(data, checksumFilename, filenames...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := newHash(checksum.Algorithm); err != nil {
+		return nil, err
+	}
+	dldr.hashAlgorithms = append(dldr.hashAlgorithms, checksum.Algorithm)
+	return checksum, nil
+}
+
+// Internal: download a checksum file
+func (dldr *MultiDownloader) fetchChecksums(url string) ([]byte, error) {
+	ctx := context.Background()
+	if dldr.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dldr.timeout)
+		defer cancel()
+	}
+	req, err := dldr.newRequest(ctx, "GET", url)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dldr.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(url, resp)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxChecksumFileSize))
+}
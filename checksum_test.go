@@ -0,0 +1,90 @@
+package multipartdownloader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+func TestParseChecksums (t *testing.T) {
+	sha256 := quijoteDigests["sha256"]
+	md5 := quijoteDigests["md5"]
+	testTable := []struct {
+		checksumFilename string
+		data string
+		algorithm string
+		digest string
+	} {
+		// GNU, text and binary modes
+		{"SHA256SUMS", "0000000000000000000000000000000000000000000000000000000000000000  other.txt\n" +
+			sha256 + "  quijote.txt\n", "sha256", sha256},
+		{"SHA256SUMS", sha256 + " *./dist/quijote.txt\n", "sha256", sha256},
+		{"MD5SUMS", "# Checksums\n\n" + md5 + "  quijote.txt\n", "md5", md5},
+		// Algorithm from the digest length
+		{"CHECKSUMS", md5 + "  quijote.txt\n", "md5", md5},
+		// BSD
+		{"CHECKSUM", "SHA256 (other.txt) = 00\nSHA256 (quijote.txt) = " + sha256 + "\n", "sha256", sha256},
+		{"CHECKSUM", "MD5(quijote.txt)= " + md5, "md5", md5},
+		{"CHECKSUM", "SHA1 (quijote.txt) = " + quijoteDigests["sha1"], "sha1", quijoteDigests["sha1"]},
+		// Bare digest
+		{"quijote.txt.sha512", quijoteDigests["sha512"] + "\n", "sha512", quijoteDigests["sha512"]},
+		{"quijote.txt.b2", quijoteDigests["blake2b"], "blake2b", quijoteDigests["blake2b"]},
+		{"B2SUMS", quijoteDigests["blake2b"] + "  quijote.txt\n", "blake2b", quijoteDigests["blake2b"]},
+		// "b2" only tells the algorithm as a whole word
+		{"jdk-b21-sums.txt", sha256 + "  quijote.txt\n", "sha256", sha256},
+	}
+	for _, test := range testTable {
+		checksum, err := ParseChecksums([]byte(test.data), test.checksumFilename, "quijote.txt")
+		if err != nil {
+			t.Error("Parsing", test.data, "failed:", err)
+			continue
+		}
+		if checksum.Algorithm != test.algorithm || checksum.Digest != test.digest {
+			t.Error("Parsing", test.data, "should give", test.algorithm, test.digest, "got", checksum)
+		}
+	}
+
+	for _, data := range []string{"", sha256 + "  other.txt\n", "00\n11\n", "SHA256 (other.txt) = " + sha256, "0123  quijote.txt"} {
+		if checksum, err := ParseChecksums([]byte(data), "SUMS", "quijote.txt"); err == nil {
+			t.Error("Parsing", data, "should fail, got", checksum)
+		}
+	}
+}
+
+func TestLoadChecksum (t *testing.T) {
+	dir, err := ioutil.TempDir("", "checksums")
+	failOnError(t, err)
+	defer os.RemoveAll(dir)
+	sums := quijoteDigests["sha1"] + "  quijote2.txt\n" + quijoteDigests["sha1"] + "  quijote.txt\n"
+	failOnError(t, ioutil.WriteFile(filepath.Join(dir, "SHA1SUMS"), []byte(sums), 0666))
+	sumsServer := testserver.New(dir, testserver.Faults{})
+	defer sumsServer.Close()
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+
+	for _, location := range []string{filepath.Join(dir, "SHA1SUMS"), sumsServer.FileURL("SHA1SUMS")} {
+		dldr := New([]string{server.FileURL("quijote.txt")}, WithConnections(4))
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+		checksum, err := dldr.LoadChecksum(location)
+		failOnError(t, err)
+		if checksum.Algorithm != "sha1" || checksum.Digest != quijoteDigests["sha1"] {
+			t.Error("Wrong checksum loaded from", location, checksum)
+		}
+		_, err = dldr.SetupFile("___checksumFile___")
+		failOnError(t, err)
+		failOnError(t, dldr.Download(nil))
+		failOnError(t, dldr.Verify(checksum.Algorithm, checksum.Digest))
+		os.Remove("___checksumFile___")
+	}
+
+	dldr := New([]string{server.FileURL("quijote.txt")})
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	if _, err := dldr.LoadChecksum(sumsServer.FileURL("MD5SUMS")); err == nil {
+		t.Error("Loading a missing checksum file should fail")
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	md "github.com/alvatar/multipart-downloader"
+)
+
+const daemonSocket = "godl.sock"
+
+// States of a job
+const (
+	jobRunning = "running"
+	jobPaused = "paused"
+	jobCanceled = "canceled"
+	jobCompleted = "completed"
+	jobFailed = "failed"
+)
+
+// A download submitted to the daemon, with the options of a file of an input file
+type jobRequest struct {
+	URLs []string    `json:"urls"`
+	Out string       `json:"out,omitempty"`
+	Dir string       `json:"dir,omitempty"`
+	Checksum string  `json:"checksum,omitempty"`
+	Split int        `json:"split,omitempty"`
+}
+
+// Status of a job, as returned by the API
+type jobStatus struct {
+	Id int                           `json:"id"`
+	jobRequest
+	State string                     `json:"state"`
+	Error string                     `json:"error,omitempty"`
+	Filename string                  `json:"filename,omitempty"` // Output file, once completed
+	Size int64                       `json:"size"`               // Length of the file, -1 if unknown yet
+	Downloaded int64                 `json:"downloaded"`
+	Progress []md.ConnectionProgress `json:"progress"`
+}
+
+// A download managed by the daemon
+type job struct {
+	mu sync.Mutex
+	status jobStatus
+	entry inputEntry
+	stopping string              // State requested by pause or cancel while running
+	cancel context.CancelFunc    // Stops the running download
+	done chan struct{}           // Closed when the running download stops
+}
+
+// Downloads submitted through a local HTTP API, sharing a connection budget
+//
+// The API is meant for local programs, not web pages: jobs are given as application/json,
+// and requests telling an Origin are refused. Output files are written within a download
+// directory.
+//
+//     GET  /jobs               List all jobs
+//     POST /jobs               Add a job, given a jobRequest
+//     GET  /jobs/{id}          Get a job, with the progress of its connections
+//     POST /jobs/{id}/pause    Stop a running job, keeping its .part file to resume it
+//     POST /jobs/{id}/resume   Run a paused or failed job again
+//     POST /jobs/{id}/cancel   Stop a job for good
+type daemon struct {
+	ctx context.Context          // Pauses all jobs when done
+	options []md.Option          // Options of all downloaders
+	root string                  // Directory the output files are written within
+	wg sync.WaitGroup            // Running jobs
+	mu sync.Mutex
+	jobs []*job                  // The id of a job is its index + 1
+}
+
+func newDaemon(ctx context.Context, options []md.Option, maxConns int, root string) *daemon {
+	budget := md.NewConnectionBudget(maxConns)
+	return &daemon{
+		ctx: ctx,
+		options: append(options[:len(options):len(options)], md.WithConnectionBudget(budget)),
+		root: root,
+	}
+}
+
+// Default address of the API: a Unix socket only the user can connect to, in the runtime
+// directory of the user if there is one
+func defaultDaemonAddress() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return "unix:" + filepath.Join(dir, daemonSocket)
+}
+
+// Listen on a TCP address, or a Unix socket given as unix:path
+func listenDaemon(listen string) (net.Listener, error) {
+	if !strings.HasPrefix(listen, "unix:") {
+		return net.Listen("tcp", listen)
+	}
+	path := listen[len("unix:"):]
+	listener, err := net.Listen("unix", path)
+	// A socket left behind by a daemon that didn't stop cleanly
+	if err != nil {
+		if info, statErr := os.Lstat(path); statErr == nil && info.Mode() & os.ModeSocket != 0 {
+			if conn, dialErr := net.Dial("unix", path); dialErr == nil {
+				conn.Close()
+			} else if os.Remove(path) == nil {
+				listener, err = net.Listen("unix", path)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Run the daemon until the context is done, then pause all jobs
+func runDaemon(ctx context.Context, args []string, options []md.Option) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	listen := flags.String("listen", defaultDaemonAddress(), "Address of the API, or unix:path for a Unix socket")
+	root := flags.String("dir", ".", "Directory the files are downloaded to, jobs can only choose subdirectories of it")
+	flags.Parse(args)
+
+	listener, err := listenDaemon(*listen)
+	exitOnError(err)
+	log.Println("Listening on", listener.Addr())
+
+	d := newDaemon(ctx, options, int(*maxConns), *root)
+	server := &http.Server{Handler: d}
+	go server.Serve(listener)
+	<-ctx.Done()
+	server.Shutdown(context.Background())
+	d.wg.Wait()
+}
+
+// Add a job and start it
+func (d *daemon) add(req jobRequest) (*job, error) {
+	if len(req.URLs) == 0 {
+		return nil, errors.New("No URLs provided")
+	}
+	if req.Split < 0 {
+		return nil, fmt.Errorf("Invalid number of connections %d", req.Split)
+	}
+	if strings.ContainsAny(req.Out, `/\`) || req.Out == "." || req.Out == ".." {
+		return nil, fmt.Errorf("Invalid output filename %q, it can't have directories", req.Out)
+	}
+	dir, err := d.jobDir(req.Dir)
+	if err != nil {
+		return nil, err
+	}
+	entry := inputEntry{urls: req.URLs, out: req.Out, dir: dir, conns: req.Split}
+	if req.Checksum != "" {
+		checksum, err := parseChecksum(req.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		entry.checksum = checksum
+	}
+
+	d.mu.Lock()
+	j := &job{entry: entry, status: jobStatus{Id: len(d.jobs) + 1, jobRequest: req, Size: -1}}
+	d.jobs = append(d.jobs, j)
+	d.mu.Unlock()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	d.start(j)
+	return j, nil
+}
+
+// Internal: the directory of a job, given relative to the download directory
+func (d *daemon) jobDir(dir string) (string, error) {
+	dir = filepath.Clean(filepath.FromSlash(dir))
+	if filepath.IsAbs(dir) || filepath.VolumeName(dir) != "" || dir == ".." ||
+		strings.HasPrefix(dir, ".." + string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid directory %q, it must be within the download directory", dir)
+	}
+	return filepath.Join(d.root, dir), nil
+}
+
+// Get a job by id, nil if there is none
+func (d *daemon) job(id int) *job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if id < 1 || id > len(d.jobs) {
+		return nil
+	}
+	return d.jobs[id-1]
+}
+
+// Internal: run the download of a job, which must not be running. The job must be locked.
+func (d *daemon) start(j *job) {
+	ctx, cancel := context.WithCancel(d.ctx)
+	done := make(chan struct{})
+	j.status.State, j.status.Error = jobRunning, ""
+	j.stopping, j.cancel, j.done = "", cancel, done
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		// Resuming takes the .part file and state left behind by the previous run
+		entry := newQueueEntry(j.entry, d.options)
+		stopMetrics := watchMetrics(entry.Downloader)
+		result := entry.Run(ctx, j.update)
+		stopMetrics()
+		cancel()
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		var canceled *md.CanceledError
+		switch {
+		case result.Err == nil:
+			j.status.State, j.status.Filename, j.status.Size = jobCompleted, result.Filename, result.Size
+			j.status.Downloaded = result.Size
+		case j.stopping != "":
+			j.status.State = j.stopping
+		case errors.As(result.Err, &canceled):
+			// The daemon is stopping
+			j.status.State = jobPaused
+		default:
+			j.status.State, j.status.Error = jobFailed, result.Err.Error()
+		}
+		close(done)
+	}()
+}
+
+// Internal: keep the progress of the running download
+func (j *job) update(progress []md.ConnectionProgress) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Progress = append(j.status.Progress[:0], progress...)
+	j.status.Size, j.status.Downloaded = 0, 0
+	for _, p := range progress {
+		if p.End < 0 {
+			j.status.Size = -1
+		} else if j.status.Size >= 0 {
+			j.status.Size += p.End - p.Begin
+		}
+		j.status.Downloaded += p.Current - p.Begin
+	}
+}
+
+// Get the status of a job
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Progress = append([]md.ConnectionProgress{}, j.status.Progress...)
+	return status
+}
+
+// Internal: stop a running job, leaving it in the given state once stopped
+func (j *job) stop(state string) {
+	j.stopping = state
+	j.cancel()
+	done := j.done
+	j.mu.Unlock()
+	<-done
+	j.mu.Lock()
+}
+
+// Pause a running job
+func (d *daemon) pause(j *job) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.State != jobRunning {
+		return fmt.Errorf("Job %d is %s, not running", j.status.Id, j.status.State)
+	}
+	j.stop(jobPaused)
+	return nil
+}
+
+// Resume a paused or failed job
+func (d *daemon) resume(j *job) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.State != jobPaused && j.status.State != jobFailed {
+		return fmt.Errorf("Job %d is %s, not paused", j.status.Id, j.status.State)
+	}
+	d.start(j)
+	return nil
+}
+
+// Cancel a job that isn't completed. Its .part file is left behind.
+func (d *daemon) cancel(j *job) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch j.status.State {
+	case jobRunning:
+		j.stop(jobCanceled)
+	case jobPaused, jobFailed:
+		j.status.State = jobCanceled
+	default:
+		return fmt.Errorf("Job %d is already %s", j.status.Id, j.status.State)
+	}
+	return nil
+}
+
+// Serve the API
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Browsers tell the origin of the requests of web pages, which must not reach the API
+	if r.Header.Get("Origin") != "" {
+		writeError(w, http.StatusForbidden, errors.New("Requests from web pages are not allowed"))
+		return
+	}
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if path[0] != "jobs" || len(path) > 3 {
+		writeError(w, http.StatusNotFound, errors.New("Not found"))
+		return
+	}
+
+	if len(path) == 1 {
+		switch r.Method {
+		case "GET":
+			d.mu.Lock()
+			jobs := append([]*job{}, d.jobs...)
+			d.mu.Unlock()
+			statuses := make([]jobStatus, len(jobs))
+			for i, j := range jobs {
+				statuses[i] = j.snapshot()
+			}
+			writeJSON(w, http.StatusOK, statuses)
+		case "POST":
+			// Web pages can send other content types without asking first
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("Jobs must be given as application/json"))
+				return
+			}
+			var req jobRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid job: %v", err))
+				return
+			}
+			j, err := d.add(req)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, j.snapshot())
+		default:
+			writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(path[1])
+	j := d.job(id)
+	if err != nil || j == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("No job %s", path[1]))
+		return
+	}
+	if len(path) == 2 {
+		if r.Method != "GET" {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+			return
+		}
+		writeJSON(w, http.StatusOK, j.snapshot())
+		return
+	}
+
+	actions := map[string]func(*job) error{"pause": d.pause, "resume": d.resume, "cancel": d.cancel}
+	action, ok := actions[path[2]]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("Not found"))
+		return
+	}
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+		return
+	}
+	if err := action(j); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, j.snapshot())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 	md "github.com/alvatar/multipart-downloader"
@@ -12,11 +18,15 @@ import (
 
 var (
 	nConns   = flag.Uint("n", 1, "Number of concurrent connections")
-	sha256   = flag.String("S", "", "File containing SHA-256 hash, or a SHA-256 string")
+	sha256   = flag.String("S", "", "A SHA-256 string, or the path or URL of a checksum file such as SHA256SUMS")
 	useEtag  = flag.Bool("E", false, "Verify using ETag as MD5")
 	timeout  = flag.Uint("t", 5000, "Timeout for all connections in milliseconds")
-	output   = flag.String("o", "", "Output file")
+	output   = flag.String("o", "", "Output file, - for the standard output")
 	verbose  = flag.Bool("v", false, "Verbose output")
+	limitRate = flag.String("limit-rate", "", "Maximum download speed in bytes per second, with an optional K, M or G suffix")
+	inputFile = flag.String("i", "", "Download the files listed in a file, - for the standard input")
+	maxConns = flag.Uint("j", 8, "Connections shared by all the files listed with -i")
+	metricsAddr = flag.String("metrics-addr", "", "Serve Prometheus metrics at this address, such as localhost:9090")
 )
 
 func exitOnError(err error) {
@@ -26,15 +36,48 @@ func exitOnError(err error) {
 	}
 }
 
+// Parse a size such as 512, 100K, 10M or 1.5G, in powers of 1024
+func parseSize(s string) (int64, error) {
+	multiplier := 1.0
+	if n := len(s); n > 0 {
+		switch strings.ToUpper(s[n-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Invalid size: %q", s)
+	}
+	return int64(value * multiplier), nil
+}
+
+// Whether a string is a SHA-256 digest rather than a checksum file
+func isSHA256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
 func main() {
 	flag.Parse()
 	log.SetPrefix("godl: ")
-	if len(flag.Args()) == 0 {
+	if len(flag.Args()) == 0 && *inputFile == "" {
 		log.Fatal("No URLs provided")
 		os.Exit(1)
 	}
 
-	// Register signals
+	// Register signals, the first one stops the download gracefully
+	ctx, cancel := context.WithCancel(context.Background())
 	sigc := make(chan os.Signal, 1)
 	signal.Notify(sigc,
 		os.Interrupt,
@@ -43,6 +86,10 @@ func main() {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 	go func() {
+		<-sigc
+		log.Println("Stopping download...")
+		cancel()
+		// Don't wait any longer if the user insists
 		<-sigc
 		log.Fatal("Exit with incomplete download")
 		os.Exit(1)
@@ -52,39 +99,129 @@ func main() {
 		log.Println("Initializing download with", *nConns, "concurrent connections")
 	}
 
-	// Initialize download
-	dldr := md.NewMultiDownloader(flag.Args(), int(*nConns), time.Duration(*timeout) * time.Millisecond)
+	var rate int64
+	if *limitRate != "" {
+		var err error
+		rate, err = parseSize(*limitRate)
+		exitOnError(err)
+	}
+
+	// Hash while downloading when possible, instead of reading the file again
+	var hashes []string
+	if isSHA256(*sha256) {
+		hashes = append(hashes, "sha256")
+	}
+	if *useEtag {
+		hashes = append(hashes, "md5")
+	}
+
+	// The files of a queue or the daemon share the bandwidth limit, rather than each having it
+	options := []md.Option{
+		md.WithConnections(int(*nConns)),
+		md.WithTimeout(time.Duration(*timeout) * time.Millisecond),
+		md.WithRateLimiter(md.NewRateLimiter(rate)),
+		md.WithHashes(hashes...),
+	}
 	md.SetVerbose(*verbose)
+	if *metricsAddr != "" {
+		serveMetrics(*metricsAddr)
+	}
+
+	// A long-lived process downloading the files submitted through its API
+	if flag.Arg(0) == "daemon" {
+		if *inputFile != "" || *output != "" {
+			log.Fatal("The daemon takes the output files along with the URLs of each download")
+			os.Exit(1)
+		}
+		runDaemon(ctx, flag.Args()[1:], options)
+		return
+	}
+
+	// A list of files, each with its mirrors and options
+	if *inputFile != "" {
+		if len(flag.Args()) > 0 || *output != "" {
+			log.Fatal("With -i, the URLs and output files are given in the input file")
+			os.Exit(1)
+		}
+		if !downloadList(ctx, *inputFile, options) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// A Metalink document lists the mirrors of one or more files
+	if len(flag.Args()) == 1 && md.IsMetalink(flag.Arg(0)) {
+		metalink, err := md.LoadMetalink(flag.Arg(0), options...)
+		exitOnError(err)
+		if len(metalink.Files) > 1 && *output != "" {
+			log.Fatal("The Metalink document has several files, -o can't be used")
+			os.Exit(1)
+		}
+		for i := range metalink.Files {
+			file := &metalink.Files[i]
+			if len(file.Mirrors) == 0 {
+				log.Fatal("No HTTP mirrors for ", file.Name)
+				os.Exit(1)
+			}
+			output := *output
+			if output == "" {
+				output = file.Name
+			}
+			if *verbose {
+				log.Println("Downloading", file.Name, "from", len(file.Mirrors), "mirrors")
+			}
+			downloadFile(ctx, md.NewFromMetalink(file, options...), output, file.Checksum())
+		}
+		return
+	}
+
+	downloadFile(ctx, md.New(flag.Args(), options...), *output, nil)
+}
+
+// Download a file and verify it, given its expected digest if known. Exit on error.
+func downloadFile(ctx context.Context, dldr *md.MultiDownloader, output string, checksum *md.Checksum) {
+	defer watchMetrics(dldr)()
 
 	// Gather info from all sources
-	chunks, err := dldr.GatherInfo()
+	_, err := dldr.GatherInfoContext(ctx)
 	exitOnError(err)
 
-	// Prepare the file to write individual blocks on
-	_, err = dldr.SetupFile(*output)
-	exitOnError(err)
+	// The digest given in the command line goes first, from a checksum file if not literal
+	if isSHA256(*sha256) {
+		checksum = &md.Checksum{Algorithm: "sha256", Digest: *sha256}
+	} else if *sha256 != "" {
+		// Find the expected digest in a checksum file, by the name of the file
+		checksum, err = dldr.LoadChecksum(*sha256)
+		exitOnError(err)
+	}
 
 	// Perform download
-	if *verbose {
-		// Setup bar visualization
-		v := NewProgress(chunks)
-		err = dldr.Download(func(feedback []md.ConnectionProgress) {
-			v.Update(feedback)
-		})
+	if output == "-" {
+		// Stream to the standard output, in order. Progress bars would be mixed with the data.
+		err = dldr.DownloadToContext(ctx, os.Stdout, nil)
 	} else {
-		err = dldr.Download(nil)
+		// Prepare the file to write individual blocks on, resuming a previous download if possible
+		_, err = dldr.SetupFile(output)
+		exitOnError(err)
+		err = download(ctx, dldr)
+	}
+	var canceled *md.CanceledError
+	if errors.As(err, &canceled) {
+		if output == "-" {
+			log.Fatal("Exit with incomplete download")
+		} else {
+			log.Fatal("Exit with incomplete download, run the same command again to resume")
+		}
+		os.Exit(1)
 	}
 	exitOnError(err)
 
-	// Perform SHA256 check if requested
-	if *sha256 != "" {
-		err := dldr.CheckSHA256(*sha256)
+	// Perform checksum check if requested
+	if checksum != nil {
+		err := dldr.Verify(checksum.Algorithm, checksum.Digest)
 		exitOnError(err)
-		if err != nil {
-			log.Fatal(err)
-			os.Exit(1)
-		} else if *verbose {
-			log.Println("SHA-256 checked successfully")
+		if *verbose {
+			log.Println(strings.ToUpper(checksum.Algorithm), "checked successfully")
 		}
 	}
 
@@ -92,11 +229,22 @@ func main() {
 	if *useEtag {
 		err := dldr.CheckMD5(dldr.ETag)
 		exitOnError(err)
-		if err != nil {
-			log.Fatal(err)
-			os.Exit(1)
-		} else if *verbose {
+		if *verbose {
 			log.Println("MD5SUM checked successfully")
 		}
 	}
 }
+
+// Download to the file, showing the progress if verbose
+func download(ctx context.Context, dldr *md.MultiDownloader) (err error) {
+	if *verbose {
+		// Setup bar visualization
+		v := NewProgress(dldr)
+		err = dldr.DownloadContext(ctx, func(feedback []md.ConnectionProgress) {
+			v.Update(feedback)
+		})
+	} else {
+		err = dldr.DownloadContext(ctx, nil)
+	}
+	return
+}
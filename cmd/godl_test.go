@@ -1,9 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	md "github.com/alvatar/multipart-downloader"
+	"github.com/alvatar/multipart-downloader/internal/testserver"
 )
 
 func TestNoArgs (t *testing.T) {
@@ -23,7 +37,9 @@ func TestNoUrls (t *testing.T) {
 }
 
 func TestWrongUrl (t *testing.T) {
-	cmd := exec.Command("../godl", "http://example.com/nothing")
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	cmd := exec.Command("../godl", server.FileURL("nothing"))
 	err := cmd.Run()
 	if err == nil { // exit code 0
 		t.Error("Running godl with a wrong URL should exit with error")
@@ -31,7 +47,9 @@ func TestWrongUrl (t *testing.T) {
 }
 
 func TestUrl (t *testing.T) {
-	cmd := exec.Command("../godl", "-o", "tmp_file", "https://raw.githubusercontent.com/alvatar/multipart-downloader/master/LICENSE")
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	cmd := exec.Command("../godl", "-o", "tmp_file", server.FileURL("quijote.txt"))
 	err := cmd.Run()
 	if err != nil {
 		t.Error("Running godl with -o output_file and an URL should be successful")
@@ -43,3 +61,445 @@ func TestUrl (t *testing.T) {
 	}
 	os.Remove("tmp_file")
 }
+
+func TestParseSize (t *testing.T) {
+	testTable := []struct {
+		s string
+		size int64
+	} {
+		{"512", 512},
+		{"100K", 100 << 10},
+		{"10M", 10 << 20},
+		{"1.5g", 3 << 29},
+	}
+	for _, test := range testTable {
+		if size, err := parseSize(test.s); err != nil || size != test.size {
+			t.Error("Size", test.s, "should be", test.size, "got", size, err)
+		}
+	}
+	for _, s := range []string{"", "M", "ten", "-1K"} {
+		if _, err := parseSize(s); err == nil {
+			t.Error("Size", s, "should be invalid")
+		}
+	}
+}
+
+func TestLimitRate (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	cmd := exec.Command("../godl", "-limit-rate", "10M", "-o", "tmp_file", server.FileURL("quijote.txt"))
+	if err := cmd.Run(); err != nil {
+		t.Error("Running godl with -limit-rate should be successful")
+	}
+	os.Remove("tmp_file")
+	cmd = exec.Command("../godl", "-limit-rate", "fast", server.FileURL("quijote.txt"))
+	if err := cmd.Run(); err == nil {
+		t.Error("Running godl with an invalid rate should exit with error")
+	}
+}
+
+func TestStdout (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	reference, err := ioutil.ReadFile("../test/quijote.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("../godl", "-n", "4", "-o", "-", server.FileURL("quijote.txt"))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Error("Running godl with -o - should be successful")
+		return
+	}
+	if !bytes.Equal(reference, out) {
+		t.Error("The file written to the standard output does not match the reference file")
+	}
+}
+
+func TestStdoutSHA256 (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	cmd := exec.Command("../godl", "-n", "4", "-o", "-", "-S",
+		"1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc", server.FileURL("quijote.txt"))
+	if err := cmd.Run(); err != nil {
+		t.Error("The SHA-256 of the standard output should be checked successfully")
+	}
+	cmd = exec.Command("../godl", "-n", "4", "-o", "-", "-S", "wrong-hash", server.FileURL("quijote.txt"))
+	if err := cmd.Run(); err == nil {
+		t.Error("A wrong SHA-256 of the standard output should exit with error")
+	}
+}
+
+func TestChecksumFile (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	sums := "1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc  quijote.txt\n"
+	if err := ioutil.WriteFile("tmp_SHA256SUMS", []byte(sums), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("tmp_SHA256SUMS")
+	cmd := exec.Command("../godl", "-o", "tmp_file", "-S", "tmp_SHA256SUMS", server.FileURL("quijote.txt"))
+	if err := cmd.Run(); err != nil {
+		t.Error("The SHA-256 from a checksum file should be checked successfully")
+	}
+	os.Remove("tmp_file")
+	cmd = exec.Command("../godl", "-o", "tmp_file", "-S", "tmp_SHA256SUMS", server.FileURL("quijote2.txt"))
+	if err := cmd.Run(); err == nil {
+		t.Error("A checksum file without the downloaded file should exit with error")
+	}
+	os.Remove("tmp_file")
+}
+
+func TestMetalink (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	doc := `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="tmp_metalink_file">
+    <hash type="sha-256">1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc</hash>
+    <url priority="1">` + server.FileURL("quijote.txt") + `</url>
+    <url priority="2">` + server.FileURL("quijote2.txt") + `</url>
+  </file>
+</metalink>`
+	if err := ioutil.WriteFile("tmp.meta4", []byte(doc), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("tmp.meta4")
+	cmd := exec.Command("../godl", "-n", "2", "tmp.meta4")
+	if err := cmd.Run(); err != nil {
+		t.Error("Running godl with a Metalink document should be successful")
+	}
+	if _, err := os.Stat("tmp_metalink_file"); err != nil {
+		t.Error("The file should be named after the Metalink document")
+	}
+	os.Remove("tmp_metalink_file")
+
+	// The hash of the document is checked
+	if err := ioutil.WriteFile("tmp.meta4", []byte(strings.Replace(doc, "1e9b", "0000", 1)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command("../godl", "-n", "2", "tmp.meta4")
+	if err := cmd.Run(); err == nil {
+		t.Error("A wrong hash in the Metalink document should exit with error")
+	}
+	os.Remove("tmp_metalink_file")
+}
+
+func TestParseInputFile (t *testing.T) {
+	list := `# Nightly artifacts
+http://a/file1	http://b/file1
+  out=first
+  checksum=sha-256=1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc
+
+http://a/file2
+	mirror=http://b/file2
+	dir=artifacts
+	split=4
+`
+	entries, err := parseInputFile(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 ||
+		strings.Join(entries[0].urls, " ") != "http://a/file1 http://b/file1" || entries[0].out != "first" ||
+		entries[0].checksum == nil || entries[0].checksum.Algorithm != "sha-256" ||
+		strings.Join(entries[1].urls, " ") != "http://a/file2 http://b/file2" || entries[1].dir != "artifacts" ||
+		entries[1].conns != 4 || entries[1].checksum != nil {
+		t.Error("Wrong entries parsed:", entries)
+	}
+
+	for _, wrong := range []string{
+		"  out=orphan\n",
+		"http://a/file\n  color=blue\n",
+		"http://a/file\n  checksum=abcdef\n",
+		"http://a/file\n  split=none\n",
+	} {
+		if _, err := parseInputFile(strings.NewReader(wrong)); err == nil {
+			t.Error("The input file should be rejected:", wrong)
+		}
+	}
+}
+
+func TestInputFile (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	list := server.FileURL("quijote.txt") + "\n" +
+		"  out=tmp_list_file1\n" +
+		"  checksum=sha-256=1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc\n" +
+		server.FileURL("quijote2.txt") + "\n" +
+		"  mirror=" + server.FileURL("quijote.txt") + "\n" +
+		"  out=tmp_list_file2\n"
+	if err := ioutil.WriteFile("tmp_list.txt", []byte(list), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("tmp_list.txt")
+	cmd := exec.Command("../godl", "-n", "2", "-j", "3", "-i", "tmp_list.txt")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Error("Running godl with an input file should be successful:", string(out))
+	}
+	for _, name := range []string{"tmp_list_file1", "tmp_list_file2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Error("The file should be downloaded:", name)
+		}
+		os.Remove(name)
+	}
+
+	// A failing download fails the whole run, without stopping the others
+	list += server.FileURL("missing.txt") + "\n"
+	if err := ioutil.WriteFile("tmp_list.txt", []byte(list), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command("../godl", "-i", "tmp_list.txt")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "OK     tmp_list_file2") || !strings.Contains(string(out), "ERROR  " + server.FileURL("missing.txt")) {
+		t.Error("The failing download should be reported, got", string(out))
+	}
+	os.Remove("tmp_list_file1")
+	os.Remove("tmp_list_file2")
+}
+
+func TestDaemon (t *testing.T) {
+	slow := testserver.New("../test", testserver.Faults{BytesPerSecond: 50000})
+	defer slow.Close()
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+
+	cmd := exec.Command("../godl", "-j", "4", "daemon", "-listen", "127.0.0.1:0")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	line, err := bufio.NewReader(stderr).ReadString('\n')
+	if err != nil || !strings.Contains(line, "Listening on ") {
+		t.Fatal("The daemon should tell its address, got", line, err)
+	}
+	api := "http://" + strings.TrimSpace(line[strings.Index(line, "Listening on ") + len("Listening on "):])
+
+	call := func(method string, path string, body string, expectedStatus int) (status jobStatus) {
+		req, _ := http.NewRequest(method, api + path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Fatal(method, path, "should answer", expectedStatus, "got", resp.StatusCode)
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return
+	}
+	waitState := func(id int, state string) (status jobStatus) {
+		for start := time.Now(); time.Since(start) < 10 * time.Second; time.Sleep(20 * time.Millisecond) {
+			if status = call("GET", "/jobs/" + strconv.Itoa(id), "", http.StatusOK); status.State == state {
+				return
+			}
+		}
+		t.Fatal("Job", id, "should be", state, "got", status)
+		return
+	}
+
+	// Pause, resume and cancel a slow download
+	status := call("POST", "/jobs", `{"urls": ["` + slow.FileURL("quijote.txt") + `"], "out": "tmp_daemon_slow", "split": 2}`, http.StatusCreated)
+	if status.Id != 1 || status.State != jobRunning {
+		t.Fatal("The job should be running, got", status)
+	}
+	defer os.Remove("tmp_daemon_slow.part")
+	defer os.Remove("tmp_daemon_slow.part.state")
+	for status.Downloaded == 0 {
+		status = call("GET", "/jobs/1", "", http.StatusOK)
+	}
+	if len(status.Progress) == 0 || status.Size != 317621 {
+		t.Error("The progress of the job should be given, got", status)
+	}
+	if status = call("POST", "/jobs/1/pause", "", http.StatusOK); status.State != jobPaused {
+		t.Error("The job should be paused, got", status)
+	}
+	if _, err := os.Stat("tmp_daemon_slow.part.state"); err != nil {
+		t.Error("The state of the paused job should be saved:", err)
+	}
+	call("POST", "/jobs/1/pause", "", http.StatusConflict)
+	if status = call("POST", "/jobs/1/resume", "", http.StatusOK); status.State != jobRunning {
+		t.Error("The job should be running again, got", status)
+	}
+	if status = call("POST", "/jobs/1/cancel", "", http.StatusOK); status.State != jobCanceled {
+		t.Error("The job should be canceled, got", status)
+	}
+	call("POST", "/jobs/1/resume", "", http.StatusConflict)
+
+	// Complete a download, and fail another one
+	call("POST", "/jobs", `{"urls": ["` + server.FileURL("quijote.txt") + `"], "out": "tmp_daemon_file",
+		"checksum": "sha-256=1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc"}`, http.StatusCreated)
+	defer os.Remove("tmp_daemon_file")
+	call("POST", "/jobs", `{"urls": ["` + server.FileURL("missing.txt") + `"]}`, http.StatusCreated)
+	if status = waitState(2, jobCompleted); status.Filename != "tmp_daemon_file" || status.Downloaded != 317621 {
+		t.Error("Wrong status of the completed job:", status)
+	}
+	if status = waitState(3, jobFailed); status.Error == "" {
+		t.Error("The error of the failed job should be given")
+	}
+
+	var jobs []jobStatus
+	resp, err := http.Get(api + "/jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewDecoder(resp.Body).Decode(&jobs)
+	resp.Body.Close()
+	if len(jobs) != 3 {
+		t.Error("All jobs should be listed, got", jobs)
+	}
+	call("GET", "/jobs/4", "", http.StatusNotFound)
+	call("POST", "/jobs", `{"urls": []}`, http.StatusBadRequest)
+
+	cmd.Process.Signal(os.Interrupt)
+	if err := cmd.Wait(); err != nil {
+		t.Error("The daemon should stop cleanly:", err)
+	}
+}
+
+// Only local programs reach the API, and the files stay within the download directory
+func TestDaemonRequests (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	root, err := ioutil.TempDir("", "godl-daemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	socket := filepath.Join(root, "godl.sock")
+	cmd := exec.Command("../godl", "daemon", "-listen", "unix:" + socket, "-dir", root)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	if line, err := bufio.NewReader(stderr).ReadString('\n'); err != nil || !strings.Contains(line, "Listening on " + socket) {
+		t.Fatal("The daemon should listen on the socket, got", line, err)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Only the user should be able to connect to the socket, got", info, err)
+	}
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	post := func(body string, header map[string]string, expectedStatus int) {
+		req, _ := http.NewRequest("POST", "http://godl/jobs", strings.NewReader(body))
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Error("Adding", body, header, "should answer", expectedStatus, "got", resp.StatusCode)
+		}
+	}
+	urls := `"urls": ["` + server.FileURL("quijote.txt") + `"]`
+	jsonType := map[string]string{"Content-Type": "application/json"}
+	post(`{` + urls + `}`, map[string]string{"Content-Type": "text/plain"}, http.StatusUnsupportedMediaType)
+	post(`{` + urls + `}`, nil, http.StatusUnsupportedMediaType)
+	post(`{` + urls + `}`, map[string]string{"Content-Type": "application/json", "Origin": "http://example.com"},
+		http.StatusForbidden)
+	for _, options := range []string{`"out": "../quijote.txt"`, `"out": "sub/quijote.txt"`, `"out": ".."`,
+		`"dir": "/tmp"`, `"dir": "../sub"`, `"dir": "sub/../.."`} {
+		post(`{` + urls + `, ` + options + `}`, jsonType, http.StatusBadRequest)
+	}
+
+	post(`{` + urls + `, "out": "quijote.txt", "dir": "sub"}`, jsonType, http.StatusCreated)
+	filename := filepath.Join(root, "sub", "quijote.txt")
+	for start := time.Now(); time.Since(start) < 5 * time.Second; time.Sleep(20 * time.Millisecond) {
+		if _, err := os.Stat(filename); err == nil {
+			break
+		}
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Error("The file should be downloaded within the download directory:", err)
+	}
+
+	cmd.Process.Signal(os.Interrupt)
+	if err := cmd.Wait(); err != nil {
+		t.Error("The daemon should stop cleanly:", err)
+	}
+}
+
+func TestFormatSpeed (t *testing.T) {
+	testTable := []struct {
+		stats md.Stats
+		speed string
+	} {
+		{md.Stats{Rate: 512, ETA: -1}, "512 B/s"},
+		{md.Stats{Rate: 1.5 * (1 << 20), ETA: 12400 * time.Millisecond}, "1.5 MiB/s, ETA 12s"},
+		{md.Stats{Rate: 100 << 10, ETA: 0}, "100.0 KiB/s, ETA 0s"},
+	}
+	for _, test := range testTable {
+		if speed := strings.TrimSpace(formatSpeed(test.stats)); speed != test.speed {
+			t.Error("Expected", test.speed, "got", speed)
+		}
+	}
+}
+
+func TestMetricsAddr (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+
+	cmd := exec.Command("../godl", "-metrics-addr", "127.0.0.1:0", "daemon", "-listen", "127.0.0.1:0")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	addresses := make(map[string]string)
+	reader := bufio.NewReader(stderr)
+	for _, prefix := range []string{"Serving metrics on ", "Listening on "} {
+		line, err := reader.ReadString('\n')
+		if err != nil || !strings.Contains(line, prefix) {
+			t.Fatal("Expected", prefix, "got", line, err)
+		}
+		addresses[prefix] = "http://" + strings.TrimSpace(line[strings.Index(line, prefix) + len(prefix):])
+	}
+
+	resp, err := http.Post(addresses["Listening on "] + "/jobs", "application/json",
+		strings.NewReader(`{"urls": ["` + server.FileURL("quijote.txt") + `"], "out": "tmp_metrics_file"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	defer os.Remove("tmp_metrics_file")
+
+	// The bytes are counted as they arrive, until the whole file is
+	downloaded := []byte("godl_downloaded_bytes_total{host=\"" + strings.TrimPrefix(server.URL, "http://") + "\"} 317621")
+	var metrics []byte
+	for start := time.Now(); time.Since(start) < 5 * time.Second; time.Sleep(20 * time.Millisecond) {
+		resp, err := http.Get(addresses["Serving metrics on "] + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if bytes.Contains(metrics, downloaded) {
+			break
+		}
+	}
+	if !bytes.Contains(metrics, downloaded) {
+		t.Error("The downloaded bytes should be exported, got", string(metrics))
+	}
+	cmd.Process.Signal(os.Interrupt)
+	cmd.Wait()
+}
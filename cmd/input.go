@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	md "github.com/alvatar/multipart-downloader"
+)
+
+// A file listed in an input file
+type inputEntry struct {
+	urls []string           // The file and its mirrors
+	out string              // Output filename, named after the sources if empty
+	dir string              // Directory of the output file, the current one if empty
+	checksum *md.Checksum   // Expected digest, if any
+	conns int               // Connections, as set by -n if 0
+}
+
+// Parse a list of files, in the style of aria2 input files
+//
+// Each line holds the URLs of a file, that is, its mirrors, separated by spaces or tabs.
+// Indented lines after it set options of the file:
+//
+//     out=name                  Output filename
+//     dir=path                  Directory of the output file
+//     checksum=sha-256=digest   Expected digest, verified after downloading
+//     mirror=url                Another mirror, can be repeated
+//     split=n                   Number of connections, instead of -n
+//
+// Empty lines and lines starting with # are skipped.
+func parseInputFile(r io.Reader) ([]inputEntry, error) {
+	var entries []inputEntry
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed == line {
+			entries = append(entries, inputEntry{urls: strings.Fields(line)})
+			continue
+		}
+
+		// An option of the last file
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("Line %d: option without a file", n)
+		}
+		entry := &entries[len(entries)-1]
+		eq := strings.Index(trimmed, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("Line %d: invalid option %q", n, trimmed)
+		}
+		value := strings.TrimSpace(trimmed[eq+1:])
+		switch strings.TrimSpace(trimmed[:eq]) {
+		case "out":
+			entry.out = value
+		case "dir":
+			entry.dir = value
+		case "checksum":
+			checksum, err := parseChecksum(value)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %v", n, err)
+			}
+			entry.checksum = checksum
+		case "mirror":
+			entry.urls = append(entry.urls, value)
+		case "split":
+			conns, err := strconv.Atoi(value)
+			if err != nil || conns < 1 {
+				return nil, fmt.Errorf("Line %d: invalid number of connections %q", n, value)
+			}
+			entry.conns = conns
+		default:
+			return nil, fmt.Errorf("Line %d: unknown option %q", n, trimmed[:eq])
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// Parse a checksum given as type=digest, such as sha-256=1e9b...
+func parseChecksum(value string) (*md.Checksum, error) {
+	algDigest := strings.SplitN(value, "=", 2)
+	if len(algDigest) != 2 {
+		return nil, fmt.Errorf("Invalid checksum %q, expected type=digest", value)
+	}
+	return &md.Checksum{Algorithm: algDigest[0], Digest: algDigest[1]}, nil
+}
+
+// Create the download of a listed file, with its own options on top of the given ones
+func newQueueEntry(entry inputEntry, options []md.Option) md.QueueEntry {
+	if entry.conns > 0 {
+		options = append(options[:len(options):len(options)], md.WithConnections(entry.conns))
+	}
+	if entry.checksum != nil {
+		options = append(options[:len(options):len(options)], md.WithHashes(entry.checksum.Algorithm))
+	}
+	return md.QueueEntry{
+		Downloader: md.New(entry.urls, options...),
+		Filename: entry.out,
+		Dir: entry.dir,
+		Checksum: entry.checksum,
+	}
+}
+
+// Download all files of an input file, - for the standard input, and print a summary.
+// Returns whether all of them were downloaded.
+func downloadList(ctx context.Context, inputFile string, options []md.Option) bool {
+	var input io.Reader = os.Stdin
+	if inputFile != "-" {
+		file, err := os.Open(inputFile)
+		exitOnError(err)
+		defer file.Close()
+		input = file
+	}
+	entries, err := parseInputFile(input)
+	exitOnError(err)
+
+	queue := md.NewQueue(int(*maxConns))
+	var stops []func()
+	for _, entry := range entries {
+		queueEntry := newQueueEntry(entry, options)
+		stops = append(stops, watchMetrics(queueEntry.Downloader))
+		queue.Add(queueEntry)
+	}
+	if *verbose {
+		log.Println("Downloading", len(entries), "files with", *maxConns, "connections")
+	}
+	results := queue.Run(ctx)
+	for _, stop := range stops {
+		stop()
+	}
+
+	// Summary of the downloads
+	ok := true
+	fmt.Fprintln(os.Stderr, "Download results:")
+	for _, r := range results {
+		name := r.Filename
+		if name == "" {
+			name = r.URLs[0]
+		}
+		if r.Err != nil {
+			ok = false
+			fmt.Fprintf(os.Stderr, "ERROR  %s: %v\n", name, r.Err)
+		} else {
+			fmt.Fprintf(os.Stderr, "OK     %s (%d bytes in %v)\n", name, r.Size, r.Duration.Round(time.Millisecond))
+		}
+	}
+	return ok
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	md "github.com/alvatar/multipart-downloader"
+	"github.com/alvatar/multipart-downloader/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics of all downloads, nil unless served with -metrics-addr
+var collector *metrics.Collector
+
+// Serve the metrics of all downloads at /metrics, while godl runs
+func serveMetrics(address string) {
+	collector = metrics.New()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	listener, err := net.Listen("tcp", address)
+	exitOnError(err)
+	log.Println("Serving metrics on", listener.Addr())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go http.Serve(listener, mux)
+}
+
+// Gather the metrics of a downloader, if they are served. Returns the function stopping it.
+func watchMetrics(dldr *md.MultiDownloader) (stop func()) {
+	if collector == nil {
+		return func() {}
+	}
+	return collector.Watch(dldr)
+}
@@ -2,38 +2,109 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"time"
+
 	md "github.com/alvatar/multipart-downloader"
 	"github.com/sethgrid/multibar"
 )
 
+const statsInterval = 500 * time.Millisecond
+
 // Progress type
 type progress struct {
+	dldr           *md.MultiDownloader
 	progressBars   *multibar.BarContainer
+	bar            *multibar.ProgressBar
+	update         multibar.ProgressFunc
+	counting       bool      // The bytes received are shown instead of the bar
+	statsTime      time.Time // Last time the speed and ETA were shown
+	speed          string    // Speed and ETA, as last shown
 }
 
 // Setup progress visualization
-func NewProgress(chunks []md.Chunk) (prog *progress) {
-	numChunks := len(chunks)
+//
+// Chunks are split among connections while downloading, so a single bar shows the
+// progress of the whole file, along with the speed and the ETA. Without chunks, the
+// length of the file is unknown, and the bytes received are shown until it is known.
+func NewProgress(dldr *md.MultiDownloader) (prog *progress) {
 	pBars, _ := multibar.New()
-
 	prog = &progress{
+		dldr: dldr,
 		progressBars: pBars,
 	}
+	if chunks := dldr.Chunks(); len(chunks) > 0 {
+		prog.makeBar(chunks)
+	}
+	return
+}
 
-	for i := 0; i < numChunks; i++ {
-		prog.progressBars.MakeBar(int(chunks[i].End - chunks[i].Begin), fmt.Sprintf("%2d:", i+1))
+// Internal: show the bar, once the length of the file is known
+func (prog *progress) makeBar(chunks []md.Chunk) {
+	total := int64(0)
+	for _, c := range chunks {
+		total += c.End - c.Begin
 	}
+	prog.update = prog.progressBars.MakeBar(int(total), "total:")
+	prog.bar = prog.progressBars.Bars[len(prog.progressBars.Bars)-1]
 
 	go prog.progressBars.Listen()
-
-	return
 }
 
 // Update values from connections progress
 func (prog *progress) Update(progressArray []md.ConnectionProgress) {
-	for i := 0; i < len(progressArray); i++ {
-		relativeProgress := int(progressArray[i].Current - progressArray[i].Begin)
-		prog.progressBars.Bars[i].Update(relativeProgress)
+	// The speed changes slowly enough not to get the statistics on every write
+	if now := time.Now(); now.Sub(prog.statsTime) >= statsInterval {
+		prog.statsTime = now
+		prog.speed = formatSpeed(prog.dldr.Stats())
+		if prog.bar != nil {
+			prog.bar.Prepend = "total: " + prog.speed
+		}
+	}
+
+	if len(progressArray) == 1 && progressArray[0].End < 0 {
+		fmt.Fprintf(os.Stderr, "\rreceived: %d bytes, %s", progressArray[0].Current, prog.speed)
+		prog.counting = true
+		return
+	}
+	if prog.update == nil {
+		chunks := make([]md.Chunk, len(progressArray))
+		for i, p := range progressArray {
+			chunks[i] = md.Chunk{Begin: p.Begin, End: p.End}
+		}
+		if prog.counting {
+			fmt.Fprintln(os.Stderr)
+			prog.counting = false
+		}
+		prog.makeBar(chunks)
+		prog.bar.Prepend = "total: " + prog.speed
+	}
+	downloaded := int64(0)
+	for _, p := range progressArray {
+		downloaded += p.Current - p.Begin
 	}
+	prog.update(int(downloaded))
 }
 
+// Format the speed of a download and its ETA, such as "1.5 MiB/s, ETA 12s"
+func formatSpeed(stats md.Stats) string {
+	speed := formatBytes(stats.Rate) + "/s"
+	if stats.ETA >= 0 {
+		speed += ", ETA " + stats.ETA.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%-22s", speed)
+}
+
+// Format a number of bytes in powers of 1024, such as 512 B, 100.0 KiB or 1.5 GiB
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	unit := 0
+	for bytes >= 1024 && unit < len(units) - 1 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%.0f %s", bytes, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[unit])
+}
@@ -1,24 +1,29 @@
 package multipartdownloader
 
 import (
-	"crypto/md5"
-	"crypto/sha256"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	tmpFileSuffix = ".part"
 	fileWriteChunk = 1 << 12
+	defaultTimeout = 5 * time.Second
 	fileReadChunk = 1 << 12
+	stateSaveInterval = time.Second
+	defaultFilename = "downloaded-file"
+	maxPieceErrors = 3  // Corrupt pieces of a chunk served by a source before it is left out
 )
 
 // Info gathered from different sources
@@ -28,140 +33,265 @@ type urlInfo struct {
 	etag string
 	connSuccess bool
 	statusCode int
+	disposition string  // Content-Disposition header
+	finalURL string     // URL after following redirects
+	acceptRanges bool   // Range requests are supported
+	digests map[string]string // Digests of the file advertised in the headers, by algorithm
+	rangesKnown bool    // The source told whether range requests are supported
 }
 
 // Chunk boundaries
+//
+// Chunks are half-open intervals: Begin is the offset of the first byte and End the offset
+// right after the last one, so End - Begin is the size of the chunk and a chunk ends where
+// the next one begins. HTTP ranges are inclusive, so a chunk is requested as bytes=Begin-(End-1).
 type Chunk struct {
 	Begin int64
 	End int64
 }
 
-// Progress feedback type
+// Progress feedback type. Begin and End follow the Chunk convention, and Current is the
+// offset of the next byte to be written. While the length of the file is unknown, there
+// is a single connection, whose End is -1: Current is then the number of bytes received.
 type ConnectionProgress struct {
-	Id int
-	Begin int64
-	End int64
-	Current int64
+	Id int         `json:"id"`
+	Begin int64    `json:"begin"`
+	End int64      `json:"end"`
+	Current int64  `json:"current"`
 }
 
 // The file downloader
 type MultiDownloader struct {
-	urls []string            // List of all sources for the file
+	urls []string            // List of all sources for the file, the ones selected by GatherInfo
+	candidates []string      // List of all sources given, probed by GatherInfo
+	quorum int               // Agreeing sources needed when tolerating disagreeing ones
+	expectedSize int64       // Length of the file, -1 if unknown
+	expectedChecksum *Checksum // Digest of the file, nil if unknown
+	excluded []ExcludedSource // Sources left out by GatherInfo
 	nConns int               // Number of max concurrent connections to use
 	timeout time.Duration    // Timeout for all connections
+	client *http.Client      // Client performing all HTTP requests
+	bufferSize int           // Size of the buffer used to copy data from connections to the file
+	partSuffix string        // Suffix of the incomplete output filename
+	logger *log.Logger       // Verbose and error output, the standard logger if nil
+	userAgent string         // User-Agent header of all requests, Go's default if empty
+	retryPolicy RetryPolicy  // When and how failed requests are retried
 	fileLength int64         // Size of the file. It could be larger than 4GB.
 	filename string          // Output filename
 	partFilename string      // Incomplete output filename
 	ETag string              // ETag (if available) of the file
+	chunkSize int64          // Maximum initial size of the chunks, chosen from nConns if 0
 	chunks []Chunk           // A table of the chunks the file is divided into
+	current []int64          // Progress of each chunk: the next offset to be written
+	active []bool            // Chunks being downloaded by a connection
+	nextPending int          // No pending chunk before this index
+	progressMu sync.Mutex    // Guards the chunks table and its progress
+	hostLimits map[string]int // Maximum concurrent connections to some hosts
+	rateLimiter *RateLimiter // Total bandwidth limit, unlimited at rate 0
+	connBudget *ConnectionBudget // Connections shared with other downloaders, no limit if nil
+	sourceRate int64         // Bandwidth limit of each source in bytes per second, none if 0
+	rangeless []bool         // Sources found by GatherInfo not to support range requests
+	sources []sourceState    // What is known about each of the urls while downloading
+	hosts map[string]*hostState // What is known about the hosts of the urls while downloading
+	sourcesMu sync.Mutex     // Guards sources and hosts
+	sink Sink                // Storage of the data, a .part file set up by SetupFile if nil
+	pieceHashes *PieceHashes // Digests of the pieces of the file, verified while downloading
+	hashAlgorithms []string  // Digests computed while downloading
+	digests map[string]string // Digests of the last download, by algorithm, if computed while downloading
+	streamBuffer int64       // Memory for reordering chunks when streaming to a writer
+	streamWindow int64       // While streaming, chunks must begin this close to the stream position
+	streamEnd int64          // While streaming, offset before which chunks can be started
+	streamCond *sync.Cond    // Signals connections waiting for the stream to advance
+	streamStopped bool       // The stream can't advance anymore
+	stats downloadStats      // Statistics of the current or last download
+	statsMu sync.Mutex       // Guards stats
+	subscribers []*Subscription // Receivers of the events, see Subscribe
+	eventsMu sync.Mutex      // Guards subscribers
+}
+
+// Error returned when a download is stopped through its context
+type CanceledError struct {
+	Err error // The context error: context.Canceled or context.DeadlineExceeded
+}
+
+func (e *CanceledError) Error() string {
+	return "Download canceled: " + e.Err.Error()
 }
 
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// Create a downloader with a number of connections and a timeout, see New for more settings
 func NewMultiDownloader(urls []string, nConns int, timeout time.Duration) *MultiDownloader {
-	return &MultiDownloader{urls: urls, nConns: nConns, timeout: timeout}
+	return New(urls, WithConnections(nConns), WithTimeout(timeout))
 }
 
-// Get the info of the file, using the HTTP HEAD request
+// Get the info of the file, using HTTP HEAD requests, or GET requests for the first byte
+// from sources that reject HEAD or don't tell the length or whether they support ranges
 func (dldr *MultiDownloader) GatherInfo() (chunks []Chunk, err error) {
-	if len(dldr.urls) == 0 {
+	return dldr.GatherInfoContext(context.Background())
+}
+
+// Get the info of the file, aborting the requests if the context is cancelled
+func (dldr *MultiDownloader) GatherInfoContext(ctx context.Context) (chunks []Chunk, err error) {
+	// Excluded sources are probed again
+	if dldr.candidates == nil {
+		dldr.candidates = dldr.urls
+	}
+	if len(dldr.candidates) == 0 {
 		return nil, errors.New("No URLs provided")
 	}
 
-	results := make(chan urlInfo)
-	defer close(results)
-
 	// Connect to all sources concurrently
-	getHead := func (url string) {
-		client := http.Client{
-			Timeout: time.Duration(dldr.timeout),
-		}
-		resp, err := client.Head(url)
-		if err != nil {
-			results <- urlInfo{url: url, connSuccess: false, statusCode: 0}
-			return
-		}
-		defer resp.Body.Close()
-		flen, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 0, 64)
-		etag := resp.Header.Get("Etag")
-		if err != nil {
-			log.Println("Error reading Content-Length from HTTP header")
-			flen = 0
-		}
-		results <- urlInfo{
-			url: url,
-			fileLength: flen,
-			etag: etag,
-			connSuccess: true,
-			statusCode: resp.StatusCode,
-		}
+	resArray := make([]urlInfo, len(dldr.candidates))
+	var wg sync.WaitGroup
+	for i, url := range dldr.candidates {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			resArray[i] = dldr.probe(ctx, url)
+		}(i, url)
 	}
-	for _, url := range dldr.urls {
-		go getHead(url)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, &CanceledError{ctx.Err()}
 	}
-
-	// Gather the results and return if something is wrong
-	resArray := make([]urlInfo, len(dldr.urls))
-	for i := 0; i < len(dldr.urls); i++ {
-		r := <-results
-		resArray[i] = r
-		if !r.connSuccess || r.statusCode != 200 {
-			return nil, errors.New(fmt.Sprintf("Failed connection to URL %s", resArray[i].url))
+	for _, r := range resArray {
+		if r.connSuccess {
+			dldr.emit(Event{Kind: EventProbed, URL: r.url, Length: r.fileLength})
+		} else {
+			dldr.emit(Event{Kind: EventProbed, URL: r.url, Length: -1, Err: probeError(r)})
 		}
 	}
 
-	// Check that all sources agree on file length and Etag
-	// Empty Etags are also accepted
-	commonFileLength := resArray[0].fileLength
-	commonEtag := resArray[0].etag
-	for _, r := range resArray[1:] {
-		if r.fileLength != commonFileLength || (len(r.etag) != 0 && r.etag != commonEtag) {
-			return nil, errors.New("URLs must point to the same file")
-		}
+	// Check that the sources agree on file length and Etag, see quorum.go
+	// Empty Etags are also accepted, and so are unknown lengths
+	resArray, identity, err := dldr.selectSources(resArray)
+	if err != nil {
+		return nil, err
+	}
+	dldr.urls = make([]string, len(resArray))
+	for u, r := range resArray {
+		dldr.urls[u] = r.url
 	}
+	commonFileLength, commonEtag := identity.length, identity.etag
 	dldr.fileLength = commonFileLength
+	// Only sources supporting ranges get more than the first chunk
+	dldr.rangeless = make([]bool, len(resArray))
+	for u, r := range resArray {
+		if !r.acceptRanges {
+			dldr.rangeless[u] = true
+			dldr.logVerbose("Source ", r.url, " doesn't support range requests")
+		}
+	}
 	if commonEtag != "" {
 		dldr.ETag = commonEtag[1:len(commonEtag)-1] // Remove the surrounding ""
 	}
-	dldr.filename = urlToFilename(resArray[0].url)
-	dldr.partFilename = dldr.filename + tmpFileSuffix
-
-	logVerbose("File length: ", dldr.fileLength, " bytes")
-	logVerbose("File name: ", dldr.filename)
-	logVerbose("Parts file name: ", dldr.partFilename)
-	logVerbose("Etag: ", dldr.ETag)
+	// Name the file after the first source
+	dldr.filename = responseFilename(resArray[0].disposition, resArray[0].finalURL, resArray[0].url)
+	dldr.partFilename = dldr.filename + dldr.partSuffix
+
+	if dldr.fileLength >= 0 {
+		dldr.logVerbose("File length: ", dldr.fileLength, " bytes")
+	} else {
+		dldr.logVerbose("File length: unknown")
+	}
+	dldr.logVerbose("File name: ", dldr.filename)
+	dldr.logVerbose("Parts file name: ", dldr.partFilename)
+	dldr.logVerbose("Etag: ", dldr.ETag)
 
 	// Build the chunks table, necessary for constructing requests
+	dldr.progressMu.Lock()
 	dldr.buildChunks()
+	dldr.progressMu.Unlock()
 
-	return dldr.chunks, nil
+	return dldr.Chunks(), nil
 }
 
-// Prepare the file used for writing the blocks of data
+// Prepare the file used for writing the blocks of data. It is not needed with a sink set
+// by WithSink, which is prepared by Download.
+//
+// If a previous run left a .part file and its state file behind, the download is
+// resumed: the chunks table and progress are restored and the file is kept as is.
+// Resuming is refused if the remote file changed in the meantime.
 func (dldr *MultiDownloader) SetupFile(filename string) (os.FileInfo, error) {
 	if filename != "" {
 		dldr.filename = filename
-		dldr.partFilename = filename + tmpFileSuffix
+		dldr.partFilename = filename + dldr.partSuffix
+	}
+	if dldr.sink != nil {
+		return nil, nil
 	}
 
-	file, err := os.Create(dldr.partFilename)
+	state, err := loadState(dldr.stateFilename())
 	if err != nil {
 		return nil, err
 	}
+	if state != nil {
+		if err := state.validate(dldr.ETag, dldr.fileLength); err != nil {
+			return nil, fmt.Errorf("Cannot resume download: %v. Remove %s to start over", err, dldr.stateFilename())
+		}
+		fileInfo, err := os.Stat(dldr.partFilename)
+		if err == nil && fileInfo.Size() == dldr.fileLength {
+			dldr.restoreState(state)
+			dldr.logVerbose("Resuming download from ", dldr.stateFilename())
+			return fileInfo, nil
+		}
+		// The state is useless without its .part file
+		if err := os.Remove(dldr.stateFilename()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Force file size in order to write arbitrary chunks. A file of unknown length grows
+	// as it is written.
+	fileSink := NewFileSink(dldr.filename, dldr.partFilename)
+	defer fileSink.Abort()
+	if err := fileSink.Truncate(knownLength(dldr.fileLength)); err != nil {
+		return nil, err
+	}
+	return fileSink.file.Stat()
+}
 
-	// Force file size in order to write arbitrary chunks
-	err = file.Truncate(dldr.fileLength)
-	fileInfo, err := file.Stat()
-	return fileInfo, err
+// Get the table of chunks the file is divided into. After SetupFile, this reflects
+// the table of a resumed download. During a download, chunks are split among
+// connections, so the table grows.
+func (dldr *MultiDownloader) Chunks() []Chunk {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	chunks := make([]Chunk, len(dldr.chunks))
+	copy(chunks, dldr.chunks)
+	return chunks
 }
 
-// Internal: build the chunks table, deciding boundaries
+// Internal: build the chunks table, deciding boundaries. It is empty if the length of the
+// file is unknown. The caller holds progressMu.
 func (dldr *MultiDownloader) buildChunks() {
+	if dldr.fileLength < 0 {
+		dldr.chunks = nil
+		dldr.current = nil
+		dldr.active = nil
+		dldr.nextPending = 0
+		return
+	}
 	// The algorithm takes care of possible rounding errors splitting into chunks
 	// by taking out the remainder and distributing it among the first chunks
-	n := int64(dldr.nConns)
+	n := dldr.numChunks()
+	if dldr.noRangeSupport() {
+		n = 1
+	}
+	if dldr.pieceHashes != nil && dldr.pieceHashes.Length > 0 {
+		dldr.buildPieceChunks(n)
+		return
+	}
 	remainder := dldr.fileLength % n
 	exactNumerator := dldr.fileLength - remainder
 	chunkSize := exactNumerator / n
 	dldr.chunks = make([]Chunk, n)
+	dldr.current = make([]int64, n)
+	dldr.active = make([]bool, n)
+	dldr.nextPending = 0
 	boundary := int64(0)
 	nextBoundary := chunkSize
 	for i := int64(0); i < n; i++ {
@@ -170,6 +300,7 @@ func (dldr *MultiDownloader) buildChunks() {
 			nextBoundary++
 		}
 		dldr.chunks[i] = Chunk{boundary, nextBoundary}
+		dldr.current[i] = boundary
 		boundary = nextBoundary
 		nextBoundary = nextBoundary + chunkSize
 	}
@@ -177,231 +308,585 @@ func (dldr *MultiDownloader) buildChunks() {
 
 // Perform the multipart download
 //
-// This algorithm handles download splitting the file into n blocks. If a connection fails, it
-// will try with other sources (as different sources may have different connection limits) then,
-// if it still fails, it will wait until other process is done. Thus, nConns really means the
-// MAXIMUM allowed connections, which will be tried at first and then adjusted.
-// The alternative approach of dividing into nSize blocks and spawn threads requests from a pool
-// of tasks has been discarded to avoid the overhead of performing potentially too many HTTP
-// requests, as a result of each thread performing many requests instead of the minimum necessary.
+// This algorithm handles download splitting the file into more chunks than connections. Each of
+// the nConns connections takes the next pending chunk and, when none is left, splits the largest
+// chunk still in progress (see scheduler.go), so fast sources take over the work of slow ones.
+// If a request fails, it is retried with other sources (as different sources may have different
+// connection limits) according to the RetryPolicy, resuming from the last written byte. If the
+// chunk still can't be completed, it is left for the other connections and the failing one is
+// closed. Thus, nConns really means the MAXIMUM allowed connections, which
+// will be tried at first and then adjusted.
 //
-// The designed algorithm tries to minimize the amount of successful HTTP requests.
+// Chunks are kept reasonably large, to avoid the overhead of performing too many HTTP requests.
 //
 // As a result of the approach taken, the number of concurrent connections can drop if no source
 // is available to accomodate the request. In any case, setting a reasonable limit is left to the
 // Take into consideration that some servers may ban your IP for some amount of time if you flood
 // them with too many requests.
+//
+// Sources on the same host share its connection limit, either set with WithHostLimit or
+// learnt when the host refuses a connection (429 or 503 status, or connection refused) while
+// others are open. A connection that finds all hosts at their limit is closed.
+//
+// Every range response must be a 206 Partial Content starting at the requested byte. Sources
+// that ignore ranges, as found by GatherInfo or while downloading, can only serve the beginning
+// of the file; if the file can't be completed otherwise, it is downloaded again from one of them
+// through a single connection. If no source supports ranges, a single connection is used.
+//
+// If the length of the file is unknown, it is downloaded through a single connection, see
+// unknown.go, with no state saved.
+//
+// With piece hashes set by WithPieceHashes, chunks are aligned to the pieces, and each piece
+// is verified as soon as it is written. A corrupt piece is downloaded again, from another
+// source if there is any.
+//
+// The feedback function receives the progress of every chunk, including the ones created while
+// downloading, with the chunk index as Id.
+//
+// The progress of each chunk is regularly saved to a state file next to the .part file, so
+// an interrupted download can be resumed later on by SetupFile. With a sink set by WithSink,
+// the data is written to the sink instead, and there is no state to resume from.
 func (dldr *MultiDownloader) Download( feedbackFunc func ([]ConnectionProgress) ) (err error) {
-	done := make(chan bool)
-	failed := make(chan bool)
-	available := make(chan bool, dldr.nConns)
+	return dldr.DownloadContext(context.Background(), feedbackFunc)
+}
+
+// Perform the multipart download, stopping when the context is cancelled
+//
+// On cancellation all in-flight range requests are aborted, the data written so far is
+// flushed to disk together with the state file, and a *CanceledError is returned.
+func (dldr *MultiDownloader) DownloadContext(ctx context.Context, feedbackFunc func ([]ConnectionProgress)) (err error) {
+	defer func() {
+		dldr.emitDownloadResult(err)
+	}()
+	sink := dldr.sink
+	var saveState func() error
+	dldr.digests = nil
+	if sink == nil {
+		// The file prepared by SetupFile, whose progress is saved to be resumed
+		fileSink := NewFileSink(dldr.filename, dldr.partFilename)
+		if err = fileSink.open(0); err != nil {
+			return
+		}
+		sink = fileSink
+		// Persist the progress, making sure it never claims more than what is on disk:
+		// connections keep writing, so the progress is taken before syncing
+		saveState = func() error {
+			state := dldr.snapshotState()
+			if err := sink.Sync(); err != nil {
+				return err
+			}
+			return state.save(dldr.stateFilename())
+		}
+	} else if err = sink.Truncate(knownLength(dldr.fileLength)); err != nil {
+		return
+	}
+
+	// Hash the data as it is written, when it is written in order
+	var w io.WriterAt = sink
+	var hashes *inlineHashes
+	if len(dldr.hashAlgorithms) > 0 {
+		if hashes, err = newInlineHashes(dldr.hashAlgorithms); err != nil {
+			return
+		}
+		w = &hashingWriterAt{sink, hashes}
+	}
+
+	if err = dldr.transfer(ctx, w, feedbackFunc, saveState); err != nil {
+		if abortErr := sink.Abort(); abortErr != nil {
+			dldr.logError("Error aborting download: ", abortErr)
+		}
+		return
+	}
+
+	if err = sink.Commit(); err != nil {
+		return
+	}
+	if hashes != nil {
+		dldr.digests = hashes.digests(dldr.fileLength)
+	}
+	if dldr.sink != nil {
+		return
+	}
+	// A missing state file just means the download completed before the first save
+	if err = os.Remove(dldr.stateFilename()); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// Internal: download all chunks with parallel connections, writing them to w
+//
+// If saveState is given, it is called regularly and whenever the download can't be completed.
+// Returns nil only if all chunks were downloaded.
+func (dldr *MultiDownloader) transfer(ctx context.Context, w io.WriterAt, feedbackFunc func ([]ConnectionProgress),
+	saveState func() error) error {
+	dldr.initSources()
+	dldr.initStats()
+
+	// Files of unknown length are downloaded through one connection, until a source tells
+	// the length. They can't be resumed, as a later run wouldn't know the length either.
+	if dldr.fileLength < 0 {
+		saveState = nil
+		if done, err := dldr.transferUnknownLength(ctx, w, feedbackFunc); done || err != nil {
+			return err
+		}
+	}
+
+	if dldr.pieceHashes != nil {
+		if err := dldr.pieceHashes.validate(dldr.fileLength); err != nil {
+			return err
+		}
+	}
+
+	// Stop all goroutines whenever we return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+
+	// The first write error aborts the whole download
+	var writeErr error
+	var writeErrOnce sync.Once
+	failWrite := func(err error) {
+		writeErrOnce.Do(func() {
+			writeErr = err
+			cancel()
+		})
+	}
+
+	// The last error of a source, reported if the download fails
+	var lastErr error
+	var lastErrMu sync.Mutex
+	setLastErr := func(err error) {
+		lastErrMu.Lock()
+		lastErr = err
+		lastErrMu.Unlock()
+	}
 
 	progress := make(chan ConnectionProgress)
 
-	// Parallel download, wait for all to return
-	downloadChunk := func(f *os.File, i int) {
-		numUrls := len(dldr.urls)
-		for {
-			// Block until there are connections available (all goroutines at first)
-			<- available
-
-			for try := 0; try < numUrls; try++ { // Try each URL before signaling failure
-				client := &http.Client{}
-				// Select URL in a Round-Robin fashion, each try is done with the next i
-				selectedUrl := dldr.urls[(i+try) % numUrls]
-
-				// Send per-range requests
-				req, err := http.NewRequest("GET", selectedUrl, nil)
-				if err != nil {
-					continue;
+	// Send progress if feedback function is provided
+	report := func(i int) bool {
+		if feedbackFunc == nil {
+			return true
+		}
+		select {
+		case progress <- dldr.chunkProgress(i):
+			return true
+		case <- ctx.Done():
+			return false
+		}
+	}
+
+	// Request the rest of a chunk from a source and write it as it arrives, until the chunk is
+	// complete. Its end may move backwards meanwhile, if another connection takes over part of it.
+	// Returns how many bytes were written, and the error that stopped the transfer if incomplete.
+	fetchChunk := func(f io.WriterAt, i int, u int, c int) (written int64, latency time.Duration, err error) {
+		url := dldr.urls[u]
+		req, err := dldr.newRequest(ctx, "GET", url)
+		if err != nil {
+			return 0, latency, err
+		}
+		cursor := dldr.getCurrent(i)
+		// Pieces are verified from their beginning, so a partial one is downloaded again
+		var hasher *pieceHasher
+		if dldr.pieceHashes != nil {
+			if begin := dldr.pieceHashes.pieceBegin(cursor); begin < cursor && begin >= dldr.chunkProgress(i).Begin {
+				cursor = begin
+				dldr.setCurrent(i, cursor)
+			}
+		}
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", cursor, dldr.chunkProgress(i).End - 1))
+		start := time.Now()
+		resp, err := dldr.client.Do(req)
+		if err != nil {
+			return 0, latency, err
+		}
+		defer resp.Body.Close()
+		latency = time.Since(start)
+		dldr.statsResponse(c, u, latency)
+
+		// Make sure the body holds the requested bytes, or the file would be silently corrupted
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			first, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+			if err != nil {
+				return 0, latency, fmt.Errorf("Source %s: %v", url, err)
+			}
+			if first != cursor || (total >= 0 && total != dldr.fileLength) {
+				return 0, latency, fmt.Errorf("Source %s sent range %s instead of bytes %d- of %d",
+					url, resp.Header.Get("Content-Range"), cursor, dldr.fileLength)
+			}
+		case http.StatusOK:
+			// The range was ignored: the body is only usable from the beginning of the file
+			dldr.setNoRanges(u)
+			if cursor != 0 {
+				if !dldr.wholeFileChunk(i) {
+					return 0, latency, fmt.Errorf("Source %s doesn't support range requests", url)
 				}
-				req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", dldr.chunks[i].Begin, dldr.chunks[i].End))
-				resp, err := client.Do(req)
-				if err != nil {
-					continue;
+				cursor = 0
+				dldr.setCurrent(i, 0)
+			}
+		default:
+			return 0, latency, newStatusError(url, resp)
+		}
+		if dldr.pieceHashes != nil {
+			hasher = dldr.pieceHashes.newHasher(cursor, dldr.fileLength)
+		}
+
+		buf := make([]byte, dldr.bufferSize)
+		// With piece hashes, data is held until its pieces are verified, so corrupt data is never
+		// written: the writer may be a stream, which can't take it back
+		var held []byte
+		for {
+			n, err := io.ReadFull(resp.Body, buf)
+			if n > 0 {
+				dldr.waitBandwidth(ctx, u, n)
+			}
+			// A cancelled request doesn't deliver any more data
+			if ctx.Err() != nil {
+				return written, latency, ctx.Err()
+			}
+			if n > 0 {
+				// The end of the chunk may have moved before the data held
+				if n = dldr.writable(i, len(held) + n) - len(held); n < 0 {
+					held, n = held[:len(held) + n], 0
 				}
-				defer resp.Body.Close()
-
-				// Read response and process it in chunks
-				buf := make([]byte, fileWriteChunk)
-				cursor := dldr.chunks[i].Begin
-				for {
-					n, err := io.ReadFull(resp.Body, buf)
-					if err == io.EOF {
-						done <- true // Signal success
-						return
+				dldr.statsReceived(c, u, n)
+				data := buf[:n]
+				// Corrupt pieces are discarded, and don't count as progress
+				if hasher != nil {
+					if piece := hasher.write(data); piece >= 0 {
+						return written, latency, &PieceError{url, piece}
+					}
+					held = append(held, data...)
+					verified := hasher.verified() - cursor
+					// Nothing follows the end of the chunk to verify its last bytes
+					if verified > int64(len(held)) || cursor + int64(len(held)) >= dldr.chunkProgress(i).End {
+						verified = int64(len(held))
 					}
+					data = held[:verified]
+				}
+				if len(data) > 0 {
 					// According to doc: "Clients of WriteAt can execute parallel WriteAt calls on the
 					// same destination if the ranges do not overlap."
-					_, errWr := f.WriteAt(buf[:n], cursor)
+					_, errWr := f.WriteAt(data, cursor)
 					if errWr != nil {
-						log.Fatal(errWr)
-						break
-					}
-					cursor += int64(n)
-
-					// Send progress if feedback function is provided
-					if feedbackFunc != nil {
-						progress <- ConnectionProgress{
-							Id: i,
-							Begin: dldr.chunks[i].Begin,
-							End: dldr.chunks[i].End,
-							Current: cursor,
-						}
+						failWrite(errWr)
+						return written, latency, errWr
 					}
+					cursor += int64(len(data))
+					written += int64(len(data))
+					dldr.setCurrent(i, cursor)
+				}
+				if hasher != nil {
+					held = append(held[:0], held[len(data):]...)
+				}
+				if !report(i) {
+					return written, latency, ctx.Err()
 				}
 			}
-
-			failed <- true // Signal failure
+			if cursor >= dldr.chunkProgress(i).End {
+				return written, latency, nil
+			}
+			if err != nil {
+				// The source closed the connection before the end of the chunk
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return written, latency, err
+			}
 		}
 	}
 
-	file, err := os.OpenFile(dldr.partFilename, os.O_WRONLY, 0666)
-	if err != nil {
-		return
-	}
+	// Download a chunk, from its last written byte, retrying according to the retry policy.
+	// Returns false if it couldn't be completed.
+	downloadChunk := func(f io.WriterAt, i int, c int) bool {
+		numUrls := len(dldr.urls)
+		skippedUrls := make(map[int]bool)  // Sources that can't serve the chunk, at least for now
+		pieceErrors := make(map[int]int)   // Corrupt pieces served by each source
+		failures := attempts{policy: &dldr.retryPolicy}
+		requests := 0       // Requests made for the chunk
+		var failure error   // Error of the last request
+		for try := 0; ; try++ {
+			if len(skippedUrls) == numUrls {
+				return false
+			}
+			// Select URL in a Round-Robin fashion, each try is done with the next i
+			u := (i+try) % numUrls
+			if skippedUrls[u] {
+				continue
+			}
+			// Sources without range support can only serve from the beginning of the file
+			if dldr.noRanges(u) && dldr.getCurrent(i) != 0 && !dldr.wholeFileChunk(i) {
+				skippedUrls[u] = true
+				continue
+			}
+			// Respect the connection limit of the host
+			if !dldr.acquireSource(u) {
+				skippedUrls[u] = true
+				continue
+			}
 
-	for i := 0; i < dldr.nConns; i++ {
-		go downloadChunk(file, i)
+			requests++
+			if failure != nil {
+				dldr.emit(Event{Kind: EventChunkRetried, Chunk: i, URL: dldr.urls[u], Attempt: requests, Err: failure})
+			}
+			requested := dldr.chunkProgress(i)
+			dldr.emit(Event{Kind: EventChunkStarted, Chunk: i, Range: Chunk{requested.Current, requested.End},
+				URL: dldr.urls[u], Attempt: requests})
+			dldr.statsRequest(c, u, i)
+			written, latency, err := fetchChunk(f, i, u, c)
+			limited := dldr.releaseSource(u, err)
+			if ctx.Err() != nil {
+				dldr.statsDone(c, u, nil)
+			} else {
+				dldr.statsDone(c, u, err)
+			}
+			if err == nil {
+				dldr.emit(Event{Kind: EventChunkCompleted, Chunk: i, Range: Chunk{requested.Current, dldr.chunkProgress(i).End},
+					URL: dldr.urls[u], Attempt: requests, Bytes: written, Latency: latency})
+				return true
+			}
+			dldr.emit(Event{Kind: EventChunkFailed, Chunk: i, URL: dldr.urls[u], Attempt: requests, Bytes: written,
+				Latency: latency, Err: err})
+			failure = err
+			if ctx.Err() != nil {
+				return false
+			}
+			dldr.logVerbose("Chunk ", i, " failed: ", err)
+			setLastErr(err)
+
+			// The host refused one connection too many: its other connections keep working
+			if limited {
+				skippedUrls[u] = true
+				continue
+			}
+
+			// Corrupt data is fetched again from another source, if there is any. The same
+			// source is only tried again a few times, as it may be serving another file.
+			var pieceErr *PieceError
+			if errors.As(err, &pieceErr) {
+				dldr.logError(err)
+				pieceErrors[u]++
+				if len(skippedUrls) + 1 < numUrls || pieceErrors[u] >= maxPieceErrors {
+					skippedUrls[u] = true
+					continue
+				}
+			}
 
-		// We start making all requested connections available
-		available <- true
+			switch failures.failed(ctx, err, written > 0) {
+			case retryStop:
+				return false
+			case retrySkip:
+				skippedUrls[u] = true
+			}
+		}
 	}
 
-	// Handle progress feedback
-	if feedbackFunc != nil {
-		progressArray := make([]ConnectionProgress, dldr.nConns)
-		for i := 0; i < dldr.nConns; i++ {
-			progressArray[i] = ConnectionProgress{
-				Id: i,
-				Begin: dldr.chunks[i].Begin,
-				End: dldr.chunks[i].End,
-				Current: dldr.chunks[i].Begin,
+	// Each connection works through chunks until there are none left, taking a connection
+	// from the budget shared with other downloaders for each of them
+	connection := func(f io.WriterAt, c int) {
+		defer wg.Done()
+		for {
+			if !dldr.connBudget.acquire(ctx) {
+				return
+			}
+			i, victim, ok := dldr.nextChunk()
+			if !ok {
+				dldr.connBudget.release()
+				return
+			}
+			// The victim of a split has a new end
+			if victim >= 0 && !report(victim) {
+				dldr.releaseChunk(i)
+				dldr.connBudget.release()
+				return
+			}
+			success := downloadChunk(f, i, c)
+			dldr.releaseChunk(i)
+			dldr.connBudget.release()
+			if !success {
+				return
 			}
 		}
+	}
+
+	// Handle progress feedback. Ends of chunks only decrease, so stale values are discarded.
+	feedbackDone := make(chan bool)
+	if feedbackFunc != nil {
+		progressArray := dldr.progressSnapshot()
 		go func() {
-			complete := 0
-			for complete < dldr.nConns {
-				p := <-progress
+			for p := range progress {
+				if p.Id < 0 {
+					progressArray = dldr.progressSnapshot()
+					feedbackFunc(progressArray)
+					continue
+				}
+				for len(progressArray) <= p.Id {
+					progressArray = append(progressArray, ConnectionProgress{Id: len(progressArray)})
+				}
+				if p.End > progressArray[p.Id].End && progressArray[p.Id].End != 0 {
+					p.End = progressArray[p.Id].End
+				}
 				progressArray[p.Id] = p
 				feedbackFunc(progressArray)
-				if p.Current >= p.End {
-					complete++
-				}
 			}
+			close(feedbackDone)
 		}()
+	} else {
+		close(feedbackDone)
 	}
 
-	remainingChunks := dldr.nConns
-	failedCount := 0
-	for remainingChunks > 0 {
-		// Block until a goroutine either succeeded or failed
-		select {
-		case <- done:
-			remainingChunks--
-			available <- true // Does not block up to nConns items
-		case <- failed:
-			failedCount++
-			if failedCount >= dldr.nConns {
-				return errors.New("The file couldn't be downloaded from any source. Aborting.")
-			}
+	// Run connections until there is nothing left they can do
+	runConnections := func(n int) {
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go connection(w, i)
 		}
+		wg.Wait()
 	}
 
-	err = os.Rename(dldr.partFilename, dldr.filename)
-	return
-}
-
-// Check SHA-256 of downloaded file
-func (dldr *MultiDownloader) CheckSHA256(sha256hash string) (err error) {
-	// Open the file and get the size
-	file, err := os.Open(dldr.filename)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			panic(err)
+	connectionsDone := make(chan bool)
+	go func() {
+		runConnections(dldr.nConns)
+		// Sources without range support can still send the whole file through one connection
+		if ctx.Err() == nil && dldr.anyNoRanges() && dldr.singleChunk() {
+			dldr.logVerbose("Falling back to a single connection")
+			if feedbackFunc != nil {
+				progress <- ConnectionProgress{Id: -1} // Signal the new chunks table
+			}
+			runConnections(1)
 		}
+		close(progress)
+		<- feedbackDone
+		close(connectionsDone)
 	}()
 
-	// Compute the SHA256
-	buf := make([] byte, fileReadChunk)
-	hash := sha256.New()
-	for {
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			panic(err)
-		}
-		if n == 0 {
-			break
-		}
-
-		if _, err := hash.Write(buf[:n]); err != nil {
-			panic(err)
-		}
+	var tick <-chan time.Time
+	if saveState != nil {
+		ticker := time.NewTicker(stateSaveInterval)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
-	computedSHA256bytes := hash.Sum(nil)
-
-	// Compare the SHA256
-	computedSHA256 := fmt.Sprintf("%x", computedSHA256bytes)
 
-	if computedSHA256 != sha256hash {
-		return errors.New(fmt.Sprintf("Computed SHA256 does not match: provided=%s computed=%s", sha256hash, computedSHA256))
+	// Block until all connections are closed
+	for running := true; running; {
+		select {
+		case <- connectionsDone:
+			running = false
+		case <- tick:
+			if err := saveState(); err != nil {
+				dldr.logError("Error saving download state: ", err)
+			}
+		case <- ctx.Done():
+			<- connectionsDone
+			running = false
+		}
 	}
-	return nil
-}
 
-// Check MD5SUM of downloaded file
-func (dldr *MultiDownloader) CheckMD5(md5sum string) (err error) {
-	// Open the file and get the size
-	file, err := os.Open(dldr.filename)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err := file.Close(); err != nil {
-			panic(err)
+	if !dldr.complete() {
+		if saveState != nil {
+			if err := saveState(); err != nil {
+				dldr.logError("Error saving download state: ", err)
+			}
 		}
-	}()
-
-	// Compute the MD5SUM
-	buf := make([] byte, fileReadChunk)
-	hash := md5.New()
-	for {
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			panic(err)
+		if writeErr != nil {
+			return writeErr
 		}
-		if n == 0 {
-			break
+		if ctx.Err() != nil {
+			return &CanceledError{ctx.Err()}
 		}
-
-		if _, err := hash.Write(buf[:n]); err != nil {
-			panic(err)
+		if lastErr != nil {
+			return fmt.Errorf("The file couldn't be downloaded from any source. Aborting. Last error: %w", lastErr)
 		}
+		return errors.New("The file couldn't be downloaded from any source. Aborting.")
 	}
-	computedMD5SUMbytes := hash.Sum(nil)
+	return nil
+}
 
-	// Compare the MD5SUM
-	computedMD5SUM := fmt.Sprintf("%x", computedMD5SUMbytes)
+// Check SHA-256 of downloaded file, see Verify
+func (dldr *MultiDownloader) CheckSHA256(sha256hash string) (err error) {
+	return dldr.Verify("sha256", sha256hash)
+}
 
-	if computedMD5SUM != md5sum {
-		return errors.New(fmt.Sprintf("Computed MD5SUM does not match: provided=%s computed=%s", md5sum, computedMD5SUM))
-	}
-	return nil
+// Check MD5SUM of downloaded file, see Verify
+func (dldr *MultiDownloader) CheckMD5(md5sum string) (err error) {
+	return dldr.Verify("md5", md5sum)
 }
 
 
 ////////////////////////////////////////////////////////////////////////////////
 // Auxiliary functions
 
+// Build a request carrying the downloader's headers
+func (dldr *MultiDownloader) newRequest(ctx context.Context, method string, url string) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if dldr.userAgent != "" {
+		req.Header.Set("User-Agent", dldr.userAgent)
+	}
+	return req.WithContext(ctx), nil
+}
+
+// Size of a file of the given length, 0 if unknown
+func knownLength(fileLength int64) int64 {
+	if fileLength < 0 {
+		return 0
+	}
+	return fileLength
+}
+
 // Get the name of the file from the URL
 func urlToFilename(urlStr string) string {
 	url, err := url.Parse(urlStr)
 	if err != nil {
-		return "downloaded-file"
+		return defaultFilename
 	}
 	_, f := path.Split(url.Path)
-	return f
+	return sanitizeFilename(f)
+}
+
+// Get the name of the file from a response: the name given by the server in its
+// Content-Disposition header, or else the name in the URL it was redirected to, or else
+// the name in the requested URL
+func responseFilename(disposition string, finalURL string, requestURL string) string {
+	if _, params, err := mime.ParseMediaType(disposition); err == nil {
+		// filename* (RFC 5987) is decoded into filename, and takes precedence
+		if f := sanitizeFilename(params["filename"]); f != defaultFilename {
+			return f
+		}
+	}
+	if finalURL != "" {
+		if f := urlToFilename(finalURL); f != defaultFilename {
+			return f
+		}
+	}
+	return urlToFilename(requestURL)
+}
+
+// Make a name given by a server safe to be used as a file name in the current directory:
+// no directories, no control characters, and no special names
+func sanitizeFilename(name string) string {
+	if name = cleanFilename(name); name == "" {
+		return defaultFilename
+	}
+	return name
+}
+
+// Internal: the safe part of a name, as for sanitizeFilename, "" if nothing usable is left
+func cleanFilename(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, path.Base(name))
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+	return name
 }
@@ -2,16 +2,17 @@ package multipartdownloader
 
 import (
 	"bytes"
-	"net"
-	"net/http"
+	"context"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"testing"
 	"time"
 
-	"github.com/hydrogen18/stoppableListener"
+	"github.com/alvatar/multipart-downloader/internal/testserver"
 )
 
 func failOnError (t *testing.T, err error) {
@@ -21,28 +22,57 @@ func failOnError (t *testing.T, err error) {
 }
 
 // MultiDownloader.GatherInfo() test
-// NOTE: this test will fail if the file LICENSE diverges from the repository
 func TestGatherInfo (t *testing.T) {
-	// Gather remote sources info
-	urls := []string{"https://raw.githubusercontent.com/alvatar/multipart-downloader/master/LICENSE"}
+	server := testserver.New("test", testserver.Faults{ETag: "0123abcd"})
+	defer server.Close()
+
+	// Gather sources info
+	urls := []string{server.FileURL("quijote.txt")}
 	dldr := NewMultiDownloader(urls, 1, time.Duration(5000) * time.Millisecond)
 	_, err := dldr.GatherInfo()
 	failOnError(t, err)
 
 	// Get the local file info and test if they match
-	file, err := os.Open("LICENSE") // For read access.
+	file, err := os.Open("test/quijote.txt") // For read access.
 	failOnError(t, err)
 	stat, err := file.Stat()
 	failOnError(t, err)
 	if stat.Size() != dldr.fileLength {
 		t.Error("Remote and reference local file sizes do not match")
 	}
+	if dldr.ETag != "0123abcd" {
+		t.Error("Unexpected ETag", dldr.ETag)
+	}
+}
+
+// Sources must agree on the file
+func TestGatherInfoMismatch (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	wrongLength := testserver.New("test", testserver.Faults{ContentLengthDelta: 1})
+	defer wrongLength.Close()
+	changingETag := testserver.New("test", testserver.Faults{ETag: "v", ChangingETag: true})
+	defer changingETag.Close()
+
+	for _, urls := range [][]string{
+		{server.FileURL("quijote.txt"), wrongLength.FileURL("quijote.txt")},
+		{changingETag.FileURL("quijote.txt"), changingETag.FileURL("quijote.txt")},
+		{server.FileURL("quijote.txt"), server.FileURL("missing.txt")},
+	} {
+		dldr := NewMultiDownloader(urls, 1, time.Duration(5000) * time.Millisecond)
+		if _, err := dldr.GatherInfo(); err == nil {
+			t.Error("Sources should not be accepted:", urls)
+		}
+	}
 }
 
 // MultiDownloader.SetupFile() test
 func TestSetupFile (t *testing.T) {
-	// Gather remote sources info
-	urls := []string{"https://raw.githubusercontent.com/alvatar/multipart-downloader/master/LICENSE"}
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+
+	// Gather sources info
+	urls := []string{server.FileURL("quijote.txt")}
 	dldr := NewMultiDownloader(urls, 1, time.Duration(5000) * time.Millisecond)
 	_, err := dldr.GatherInfo()
 	failOnError(t, err)
@@ -83,6 +113,76 @@ func TestUrlToFilename (t *testing.T) {
 	}
 }
 
+func TestResponseFilename (t *testing.T) {
+	testTable := []struct {
+		disposition string
+		finalURL string
+		filename string
+	} {
+		{`attachment; filename="release.tar.gz"`, "http://host/download?id=1", "release.tar.gz"},
+		{`attachment; filename="fallback.txt"; filename*=UTF-8''%C3%B1and%C3%BA.txt`, "", "ñandú.txt"},
+		{`attachment; filename="../../etc/passwd"`, "", "passwd"},
+		{`attachment; filename="..\\..\\boot.ini"`, "", "boot.ini"},
+		{`attachment; filename=".."`, "http://host/files/release-1.2.tar.gz", "release-1.2.tar.gz"},
+		{"inline", "http://host/files/release-1.2.tar.gz?token=x", "release-1.2.tar.gz"},
+		{"", "", "download"},
+		{"", "http://host/", "download"},
+		{`attachment; filename="/"`, "http://host/dir/", "download"},
+	}
+
+	for _, test := range testTable {
+		if f := responseFilename(test.disposition, test.finalURL, "http://host/download?id=1"); f != test.filename {
+			t.Errorf("Filename for %q %q: %q, expected %q", test.disposition, test.finalURL, f, test.filename)
+		}
+	}
+	for name, sanitized := range map[string]string{
+		"a\x01b\n": "ab",
+		" .. ": defaultFilename,
+		"C:\\Windows\\win.ini": "win.ini",
+		"": defaultFilename,
+	} {
+		if f := sanitizeFilename(name); f != sanitized {
+			t.Errorf("Sanitized %q: %q, expected %q", name, f, sanitized)
+		}
+	}
+}
+
+// Servers can name the file in Content-Disposition or by redirecting to it
+func TestGatherInfoFilename (t *testing.T) {
+	data, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/attachment":
+			w.Header().Set("Content-Disposition", `attachment; filename*=UTF-8''el%20quijote.txt`)
+		case "/redirect":
+			http.Redirect(w, r, "/files/quijote-1.0.txt", http.StatusFound)
+			return
+		case "/evil":
+			w.Header().Set("Content-Disposition", `attachment; filename="../../../tmp/evil"`)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		path string
+		filename string
+	} {
+		{"/attachment?id=1", "el quijote.txt"},
+		{"/redirect?id=1", "quijote-1.0.txt"},
+		{"/evil", "evil"},
+		{"/", defaultFilename},
+	} {
+		dldr := NewMultiDownloader([]string{server.URL + test.path}, 1, 5 * time.Second)
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+		if dldr.filename != test.filename || dldr.partFilename != test.filename + dldr.partSuffix {
+			t.Errorf("File name for %s: %q, expected %q", test.path, dldr.filename, test.filename)
+		}
+	}
+}
+
 func TestBuildChunks (t *testing.T) {
 	testTable := []struct {
 		fileLength int64
@@ -107,45 +207,58 @@ func TestBuildChunks (t *testing.T) {
 	}
 }
 
-func downloadElQuijote(t *testing.T, urls []string, n int, delete bool) *MultiDownloader {
+// Gather the info of the sources of the reference file and set up its file, named after
+// the sources if filename is empty
+func setupElQuijote(t *testing.T, filename string, urls []string, options ...Option) *MultiDownloader {
 	// Gather remote sources info
-	dldr := NewMultiDownloader(urls, n, time.Duration(5000) * time.Millisecond)
+	dldr := New(urls, options...)
 	_, err := dldr.GatherInfo()
 	failOnError(t, err)
 
-	_, err = dldr.SetupFile("")
+	_, err = dldr.SetupFile(filename)
 	failOnError(t, err)
+	return dldr
+}
 
-	err = dldr.Download(nil)
-	failOnError(t, err)
-	if delete {
-		defer func() {
-			err = os.Remove(dldr.filename)
-			failOnError(t, err)
-		}()
+// Download the reference file into the file named after the sources, comparing it unless
+// the options set a sink. The file is left for the caller, but not the .part and state
+// files of a failed download.
+func downloadElQuijote(t *testing.T, urls []string, options ...Option) (*MultiDownloader, error) {
+	dldr := setupElQuijote(t, "", urls, options...)
+	if err := dldr.Download(nil); err != nil {
+		os.Remove(dldr.partFilename)
+		os.Remove(dldr.stateFilename())
+		return dldr, err
 	}
+	if dldr.sink == nil {
+		compareElQuijote(t, dldr.filename)
+	}
+	return dldr, nil
+}
 
+func compareElQuijote(t *testing.T, filename string) {
 	// Load everything into memory and compare. Not efficient, but OK for testing
 	f1, err := ioutil.ReadFile("test/quijote.txt")
 	failOnError(t, err)
-	f2, err := ioutil.ReadFile(dldr.filename)
+	f2, err := ioutil.ReadFile(filename)
 	failOnError(t, err)
 
 	if !bytes.Equal(f1, f2) {
-		t.Fail()
+		t.Error("Downloaded file does not match the reference file")
 	}
-
-	return dldr
 }
 
 // Test SHA256 check
 func TestCheckSHA256File (t *testing.T) {
-	dldr := downloadElQuijote(t, []string{"https://raw.githubusercontent.com/alvatar/multipart-downloader/master/test/quijote.txt"}, 1, false)
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	dldr, err := downloadElQuijote(t, []string{server.FileURL("quijote.txt")}, WithConnections(1))
+	failOnError(t, err)
 	defer func() {
 		err := os.Remove(dldr.filename)
 		failOnError(t, err)
 	}()
-	err := dldr.CheckSHA256("1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc")
+	err = dldr.CheckSHA256("1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc")
 	if err != nil {
 		t.Error(err)
 	}
@@ -157,14 +270,16 @@ func TestCheckSHA256File (t *testing.T) {
 
 // Test MD5SUM check
 func TestCheckMD5SUMFile (t *testing.T) {
-	dldr := downloadElQuijote(t, []string{"https://raw.githubusercontent.com/alvatar/multipart-downloader/master/test/quijote.txt"}, 1, false)
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	dldr, err := downloadElQuijote(t, []string{server.FileURL("quijote.txt")}, WithConnections(1))
+	failOnError(t, err)
 	defer func() {
 		err := os.Remove(dldr.filename)
 		failOnError(t, err)
 	}()
 	// Compare manually with a MD5SUM generated with the command-line tool
-	// Github's ETag doesn't reflect the MD5SUM
-	err := dldr.CheckMD5("45bb5fc96bb4c67778d288fba98eee48")
+	err = dldr.CheckMD5("45bb5fc96bb4c67778d288fba98eee48")
 	if err != nil {
 		t.Error(err)
 	}
@@ -174,88 +289,109 @@ func TestCheckMD5SUMFile (t *testing.T) {
 	}
 }
 
-// Test download with 1 remote source
-func Test1SourceRemote (t *testing.T) {
+// Test download with 1 source
+func Test1Source (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
 	nConns := []int{1, 2, 5, 10}
 	for _, n := range nConns {
-		downloadElQuijote(t, []string{"https://raw.githubusercontent.com/alvatar/multipart-downloader/master/test/quijote.txt"}, n, true)
+		dldr, err := downloadElQuijote(t, []string{server.FileURL("quijote.txt")}, WithConnections(n))
+		failOnError(t, err)
+		failOnError(t, os.Remove(dldr.filename))
 	}
 }
 
-// Test download with 2 remote sources
-func Test2SourcesRemote (t *testing.T) {
+// Test download with 2 sources
+func Test2Sources (t *testing.T) {
+	server1 := testserver.New("test", testserver.Faults{})
+	defer server1.Close()
+	server2 := testserver.New("test", testserver.Faults{})
+	defer server2.Close()
 	nConns := []int{1, 2, 7, 19}
 	for _, n := range nConns {
-		downloadElQuijote(t,
+		dldr, err := downloadElQuijote(t,
 			[]string{
-				"https://raw.githubusercontent.com/alvatar/multipart-downloader/master/test/quijote2.txt",
-				"https://raw.githubusercontent.com/alvatar/multipart-downloader/master/test/quijote.txt",
+				server1.FileURL("quijote2.txt"),
+				server2.FileURL("quijote.txt"),
 			},
-			n,
-			true)
+			WithConnections(n))
+		failOnError(t, err)
+		failOnError(t, os.Remove(dldr.filename))
 	}
 }
 
-// Test download with a connection drop from one of the sources
-// This test also triggers the server connection limit case
-func TestConnectionDropLocal (t *testing.T) {
-	shutdown := make(chan bool)
-
-	go func() {
-		originalListener, err := net.Listen("tcp", ":8081")
-		if err != nil {
-			panic(err)
-		}
-
-		sl, err := stoppableListener.New(originalListener)
-		if err != nil {
-			panic(err)
-		}
-
-		http.Handle("/", http.FileServer(http.Dir("./test")))
-		server := http.Server{}
+// Test download with connection drops from one of the sources
+func TestConnectionDrop (t *testing.T) {
+	dropping := testserver.New("test", testserver.Faults{})
+	defer dropping.Close()
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
 
-		go server.Serve(sl)
+	urls := []string{dropping.FileURL("quijote.txt"), server.FileURL("quijote2.txt")}
+	dldr := New(urls, WithConnections(2), WithRetryPolicy(fastRetryPolicy()))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
 
-		// Stop this listener when the signal is received
-		<- shutdown
-		sl.Stop()
-	}()
+	// Every response of the first source breaks after 10000 bytes
+	dropping.SetFaults(testserver.Faults{DropAfter: 10000})
+	err = dldr.Download(nil)
+	failOnError(t, err)
+	compareElQuijote(t, dldr.filename)
+}
 
-	go func() {
-		originalListener, err := net.Listen("tcp", ":8082")
-		if err != nil {
-			panic(err)
-		}
+// Test download where every connection breaks, making progress through retries
+func TestConnectionDropAll (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
 
-		sl, err := stoppableListener.New(originalListener)
-		if err != nil {
-			panic(err)
-		}
+	dldr := New([]string{server.FileURL("quijote.txt")}, WithConnections(3), WithRetryPolicy(fastRetryPolicy()))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
 
-		http.Handle("/quijote2", http.FileServer(http.Dir("./test")))
-		server := http.Server{}
+	server.SetFaults(testserver.Faults{DropAfter: 50000})
+	err = dldr.Download(nil)
+	failOnError(t, err)
+	compareElQuijote(t, dldr.filename)
+}
 
-		go server.Serve(sl)
+// Test that a cancelled download stops cleanly and can be resumed
+func TestDownloadCancel (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{BytesPerSecond: 1 << 20})
+	defer server.Close()
 
-		// Stop this listener when the signal is received
-		<- shutdown
-		sl.Stop()
-	}()
+	urls := []string{server.FileURL("quijote.txt")}
+	dldr := NewMultiDownloader(urls, 4, time.Duration(5000) * time.Millisecond)
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___cancelFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	err = dldr.DownloadContext(ctx, nil)
+	canceled, ok := err.(*CanceledError)
+	if !ok || canceled.Err != context.DeadlineExceeded {
+		t.Fatal("Expected a cancellation error, got", err)
+	}
+	if _, err := os.Stat(dldr.stateFilename()); err != nil {
+		t.Fatal("State should be saved after cancellation:", err)
+	}
 
-	// Wait for 50 milliseconds for listeners to be ready
-	timer := time.NewTimer(time.Millisecond * 50)
-	<- timer.C
-
-	go downloadElQuijote(t, []string{
-		"http://localhost:8081/quijote.txt",
-		"http://localhost:8082/quijote2.txt",
-	}, 2, true)
-
-	// Wait to shutdown the listeners, hopefully in the middle of the transfer
-	// TODO: Are transfers shut down off non-gracefully (as we wish)
-	timer = time.NewTimer(time.Millisecond * 50)
-	<- timer.C
-	shutdown <- true
-	shutdown <- true
+	// Resume with the saved state
+	server.SetFaults(testserver.Faults{})
+	dldr = NewMultiDownloader(urls, 4, time.Duration(5000) * time.Millisecond)
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___cancelFile___")
+	failOnError(t, err)
+	err = dldr.Download(nil)
+	failOnError(t, err)
+	compareElQuijote(t, dldr.filename)
 }
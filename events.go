@@ -0,0 +1,143 @@
+package multipartdownloader
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const defaultEventBuffer = 256
+
+// Kind of an event, telling which fields of the event are set
+type EventKind int
+
+const (
+	EventProbed EventKind = iota  // A source was probed by GatherInfo: URL, Length, and Err if it failed
+	EventSourceExcluded           // A source was left out by GatherInfo: URL, Err
+	EventChunkStarted             // A chunk was requested from a source: Chunk, Range, URL, Attempt
+	EventChunkCompleted           // A chunk was completed: Chunk, Range, URL, Attempt, Bytes, Latency
+	EventChunkFailed              // A request for a chunk stopped before its end: Chunk, URL, Attempt, Bytes, Latency, Err
+	EventChunkRetried             // A chunk is requested again after a failure: Chunk, URL, Attempt, Err of the failure
+	EventVerificationStarted      // A digest of the file is being checked: Algorithm
+	EventVerificationFinished     // A digest of the file was checked: Algorithm, and Err if it didn't match
+	EventDownloadCompleted        // The file was downloaded: Length
+	EventDownloadFailed           // The download stopped before the end of the file: Err
+)
+
+func (kind EventKind) String() string {
+	switch kind {
+	case EventProbed:
+		return "probed"
+	case EventSourceExcluded:
+		return "source excluded"
+	case EventChunkStarted:
+		return "chunk started"
+	case EventChunkCompleted:
+		return "chunk completed"
+	case EventChunkFailed:
+		return "chunk failed"
+	case EventChunkRetried:
+		return "chunk retried"
+	case EventVerificationStarted:
+		return "verification started"
+	case EventVerificationFinished:
+		return "verification finished"
+	case EventDownloadCompleted:
+		return "download completed"
+	case EventDownloadFailed:
+		return "download failed"
+	}
+	return "unknown event"
+}
+
+// Something that happened while probing, downloading or verifying. Only the fields listed
+// for its kind are set.
+//
+// Chunk events follow every request made for a chunk: each EventChunkStarted is followed by
+// either EventChunkCompleted or EventChunkFailed, also when the download is cancelled. Chunks
+// of a file of unknown length have Id 0, and a Range ending at -1.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+	URL string         // Source the event is about
+	Chunk int          // Index of the chunk, as the Id of ConnectionProgress
+	Range Chunk        // Bytes of the chunk requested, from its first missing byte
+	Attempt int        // Number of the request for the chunk, from 1
+	Bytes int64        // Bytes written by the request for the chunk
+	Latency time.Duration // Time from the request for the chunk to its response, 0 if none arrived
+	Length int64       // Length of the file, -1 if unknown
+	Algorithm string   // Hash algorithm of a verification
+	Err error
+}
+
+// Events of a downloader, buffered until the subscriber reads them
+//
+// Events are delivered without ever waiting for the subscriber: those that don't fit in the
+// buffer are dropped, so a slow subscriber can't stall the download.
+type Subscription struct {
+	events chan Event
+	dropped int64             // Events that didn't fit in the buffer, accessed atomically
+	dldr *MultiDownloader
+}
+
+// Subscribe to the events of the downloader, buffering up to size of them, or a default
+// number if size is 0
+func (dldr *MultiDownloader) Subscribe(size int) *Subscription {
+	if size < 1 {
+		size = defaultEventBuffer
+	}
+	s := &Subscription{events: make(chan Event, size), dldr: dldr}
+	dldr.eventsMu.Lock()
+	dldr.subscribers = append(dldr.subscribers, s)
+	dldr.eventsMu.Unlock()
+	return s
+}
+
+// Get the channel the events are delivered to. It is closed by Unsubscribe.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Get the number of events dropped so far because the buffer was full
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Stop receiving events, closing the channel once the buffered ones are read
+func (s *Subscription) Unsubscribe() {
+	dldr := s.dldr
+	dldr.eventsMu.Lock()
+	defer dldr.eventsMu.Unlock()
+	for i, subscriber := range dldr.subscribers {
+		if subscriber == s {
+			dldr.subscribers = append(dldr.subscribers[:i:i], dldr.subscribers[i+1:]...)
+			close(s.events)
+			return
+		}
+	}
+}
+
+// Internal: deliver an event to all subscribers
+func (dldr *MultiDownloader) emit(event Event) {
+	dldr.eventsMu.Lock()
+	defer dldr.eventsMu.Unlock()
+	if len(dldr.subscribers) == 0 {
+		return
+	}
+	event.Time = time.Now()
+	for _, s := range dldr.subscribers {
+		select {
+		case s.events <- event:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+	}
+}
+
+// Internal: tell how a download ended
+func (dldr *MultiDownloader) emitDownloadResult(err error) {
+	if err != nil {
+		dldr.emit(Event{Kind: EventDownloadFailed, Err: err})
+	} else {
+		dldr.emit(Event{Kind: EventDownloadCompleted, Length: dldr.fileLength})
+	}
+}
@@ -0,0 +1,108 @@
+package multipartdownloader
+
+import (
+	"os"
+	"testing"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+// Events tell what happened to every source and chunk
+func TestEvents (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	dropping := testserver.New("test", testserver.Faults{DropAfter: 1000, DropCount: 1})
+	defer dropping.Close()
+
+	missing := server.FileURL("missing.txt")
+	dldr := New([]string{missing, dropping.FileURL("quijote.txt"), server.FileURL("quijote.txt")},
+		WithConnections(2), WithChunkSize(1 << 15), WithQuorum(1), WithRetryPolicy(fastRetryPolicy()))
+	subscription := dldr.Subscribe(0)
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___eventsFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+	failOnError(t, dldr.Download(nil))
+	failOnError(t, dldr.Verify("sha256", quijoteDigests["sha256"]))
+	subscription.Unsubscribe()
+
+	counts := make(map[EventKind]int)
+	var bytes int64
+	var last EventKind
+	for event := range subscription.Events() {
+		counts[event.Kind]++
+		switch event.Kind {
+		case EventProbed:
+			if (event.Err != nil) != (event.URL == missing) {
+				t.Error("Only the missing file should fail to be probed, got", event.URL, event.Err)
+			}
+		case EventSourceExcluded:
+			if event.URL != missing {
+				t.Error("Only the missing file should be excluded, got", event.URL)
+			}
+		case EventChunkCompleted, EventChunkFailed:
+			bytes += event.Bytes
+			if event.Kind == EventChunkCompleted && event.Latency <= 0 {
+				t.Error("The latency of the response should be given, got", event)
+			}
+		case EventChunkRetried:
+			if event.Err == nil || event.Attempt < 2 {
+				t.Error("A retry should tell the failure and attempt, got", event)
+			}
+		case EventVerificationStarted:
+			if last != EventDownloadCompleted || event.Algorithm != "sha256" {
+				t.Error("The verification should follow the download, got", event)
+			}
+		case EventVerificationFinished:
+			if event.Err != nil {
+				t.Error("The verification should succeed, got", event.Err)
+			}
+		case EventDownloadCompleted:
+			if event.Length != dldr.fileLength {
+				t.Error("The length of the file should be given, got", event.Length)
+			}
+		}
+		last = event.Kind
+	}
+	if subscription.Dropped() != 0 {
+		t.Error("No events should be dropped, got", subscription.Dropped())
+	}
+	if counts[EventProbed] != 3 || counts[EventSourceExcluded] != 1 || counts[EventDownloadCompleted] != 1 ||
+		counts[EventVerificationStarted] != 1 || counts[EventVerificationFinished] != 1 {
+		t.Error("Wrong events:", counts)
+	}
+	if counts[EventChunkFailed] == 0 || counts[EventChunkRetried] == 0 {
+		t.Error("The dropped connection should be reported and retried:", counts)
+	}
+	if counts[EventChunkStarted] != counts[EventChunkCompleted] + counts[EventChunkFailed] {
+		t.Error("Every chunk request should complete or fail:", counts)
+	}
+	if bytes != dldr.fileLength {
+		t.Error("The chunk requests should have written", dldr.fileLength, "bytes, got", bytes)
+	}
+}
+
+// A subscriber not reading its events doesn't stop the download
+func TestEventsDropped (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	dldr := New([]string{server.FileURL("quijote.txt")}, WithConnections(4), WithChunkSize(1 << 14))
+	subscription := dldr.Subscribe(1)
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___eventsFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+	failOnError(t, dldr.Download(nil))
+	if subscription.Dropped() == 0 {
+		t.Error("The events not fitting in the buffer should be dropped")
+	}
+	if event := <-subscription.Events(); event.Kind != EventProbed {
+		t.Error("The first event should be kept, got", event)
+	}
+	subscription.Unsubscribe()
+	if _, ok := <-subscription.Events(); ok {
+		t.Error("The events should be closed")
+	}
+}
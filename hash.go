@@ -0,0 +1,246 @@
+package multipartdownloader
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Registry of the hash algorithms known by Verify, by name
+var (
+	hashesMu sync.RWMutex
+	hashes = map[string]func() hash.Hash{
+		"md5": md5.New,
+		"sha1": sha1.New,
+		"sha256": sha256.New,
+		"sha512": sha512.New,
+		"blake2b": newBlake2b,
+		"crc32c": newCRC32C,
+	}
+)
+
+func newBlake2b() hash.Hash {
+	// Only fails with a key longer than 64 bytes
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+func newCRC32C() hash.Hash {
+	return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+}
+
+// Make an algorithm available to Verify. Names are case insensitive and dashes are
+// ignored, so "SHA-256" is "sha256".
+func RegisterHash(algorithm string, newHash func() hash.Hash) {
+	hashesMu.Lock()
+	defer hashesMu.Unlock()
+	hashes[normalizeAlgorithm(algorithm)] = newHash
+}
+
+func normalizeAlgorithm(algorithm string) string {
+	return strings.ToLower(strings.Replace(algorithm, "-", "", -1))
+}
+
+// Internal: create a hash of a registered algorithm
+func newHash(algorithm string) (hash.Hash, error) {
+	hashesMu.RLock()
+	defer hashesMu.RUnlock()
+	newHash, ok := hashes[normalizeAlgorithm(algorithm)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown hash algorithm: %s", algorithm)
+	}
+	return newHash(), nil
+}
+
+// Error for a downloaded file not matching its expected digest
+type ChecksumError struct {
+	Algorithm string
+	Expected string
+	Computed string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Computed %s does not match: provided=%s computed=%s",
+		strings.ToUpper(e.Algorithm), e.Expected, e.Computed)
+}
+
+// Hashes of data written sequentially. Writes out of order stop the hashing, as they can
+// only be hashed by reading the file again.
+type inlineHashes struct {
+	mu sync.Mutex
+	hashes map[string]hash.Hash
+	offset int64      // Data hashed so far
+	broken bool       // Some data was written out of order
+}
+
+func newInlineHashes(algorithms []string) (*inlineHashes, error) {
+	h := &inlineHashes{hashes: make(map[string]hash.Hash)}
+	for _, algorithm := range algorithms {
+		hash, err := newHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		h.hashes[normalizeAlgorithm(algorithm)] = hash
+	}
+	return h, nil
+}
+
+// Hash data written at the given offset
+func (h *inlineHashes) writeAt(p []byte, off int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.broken || len(p) == 0 {
+		return
+	}
+	if off != h.offset {
+		h.broken = true
+		return
+	}
+	for _, hash := range h.hashes {
+		hash.Write(p)
+	}
+	h.offset += int64(len(p))
+}
+
+// Hash data written sequentially
+func (h *inlineHashes) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	offset := h.offset
+	h.mu.Unlock()
+	h.writeAt(p, offset)
+	return len(p), nil
+}
+
+// Get the digests, if the whole file was hashed
+func (h *inlineHashes) digests(fileLength int64) map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.broken || h.offset != fileLength {
+		return nil
+	}
+	digests := make(map[string]string)
+	for algorithm, hash := range h.hashes {
+		digests[algorithm] = hex.EncodeToString(hash.Sum(nil))
+	}
+	return digests
+}
+
+// Writer hashing the data written through it in order
+type hashingWriterAt struct {
+	io.WriterAt
+	hashes *inlineHashes
+}
+
+func (w *hashingWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	n, err := w.WriterAt.WriteAt(p, off)
+	w.hashes.writeAt(p[:n], off)
+	return n, err
+}
+
+// Check a digest of the downloaded file, given in hexadecimal
+func (dldr *MultiDownloader) Verify(algorithm string, expected string) error {
+	return dldr.VerifyAll(map[string]string{algorithm: expected})
+}
+
+// Check several digests of the downloaded file, by algorithm
+//
+// The digests computed while downloading, as requested by WithHashes, are used if available.
+// Otherwise, the file is read once for all of them.
+func (dldr *MultiDownloader) VerifyAll(expected map[string]string) error {
+	algorithms := make([]string, 0, len(expected))
+	for algorithm := range expected {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	for _, algorithm := range algorithms {
+		dldr.emit(Event{Kind: EventVerificationStarted, Algorithm: algorithm})
+	}
+
+	computed := make(map[string]string)
+	var missing []string
+	for _, algorithm := range algorithms {
+		if digest, ok := dldr.digests[normalizeAlgorithm(algorithm)]; ok {
+			computed[algorithm] = digest
+		} else {
+			missing = append(missing, algorithm)
+		}
+	}
+	if len(missing) > 0 {
+		digests, err := dldr.computeDigests(missing)
+		if err != nil {
+			for _, algorithm := range algorithms {
+				dldr.emit(Event{Kind: EventVerificationFinished, Algorithm: algorithm, Err: err})
+			}
+			return err
+		}
+		for algorithm, digest := range digests {
+			computed[algorithm] = digest
+		}
+	}
+
+	// All digests are checked, and the first mismatch returned
+	var mismatch error
+	for _, algorithm := range algorithms {
+		var err error
+		if !strings.EqualFold(computed[algorithm], expected[algorithm]) {
+			err = &ChecksumError{algorithm, expected[algorithm], computed[algorithm]}
+			if mismatch == nil {
+				mismatch = err
+			}
+		}
+		dldr.emit(Event{Kind: EventVerificationFinished, Algorithm: algorithm, Err: err})
+	}
+	return mismatch
+}
+
+// Internal: read the downloaded data once, computing digests of several algorithms
+func (dldr *MultiDownloader) computeDigests(algorithms []string) (map[string]string, error) {
+	hashes := make([]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, len(algorithms))
+	for i, algorithm := range algorithms {
+		hash, err := newHash(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hash
+		writers[i] = hash
+	}
+
+	// Sinks that can be read back are hashed, the file otherwise
+	var reader io.Reader
+	if readerAt, ok := dldr.sink.(io.ReaderAt); ok {
+		reader = io.NewSectionReader(readerAt, 0, dldr.fileLength)
+	} else {
+		filename := dldr.filename
+		if fileSink, ok := dldr.sink.(*FileSink); ok {
+			filename = fileSink.filename
+		}
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+	if _, err := io.CopyBuffer(io.MultiWriter(writers...), reader, make([]byte, fileReadChunk)); err != nil {
+		return nil, err
+	}
+
+	digests := make(map[string]string)
+	for i, algorithm := range algorithms {
+		digests[algorithm] = hex.EncodeToString(hashes[i].Sum(nil))
+	}
+	return digests, nil
+}
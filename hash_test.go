@@ -0,0 +1,93 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"hash/fnv"
+	"os"
+	"testing"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+// Digests of test/quijote.txt, generated with the command-line tools
+var quijoteDigests = map[string]string{
+	"md5": "45bb5fc96bb4c67778d288fba98eee48",
+	"sha1": "e10ddbc97ae8104b77a2006e5d2d017fc04ecd27",
+	"sha256": "1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc",
+	"sha512": "dab84f006d203357b56b0de2d0779f78a0de555aa98a7a29a67e42b10c450896b4cd9ad901678ef67d3f352414b832ef398c170dfb2bda0c62cc3ecd9240b0ad",
+	"blake2b": "fd9ed27cb1a35b98eb400f4155cbbefcb83714e331ea867aa9914b4459f5aebb07a5bc755d1b0546950a1edc4d34a878d2ca19e6cbd5b62b14cace6828a40f61",
+	"crc32c": "76bc381f",
+}
+
+func TestVerify (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	dldr, err := downloadElQuijote(t, []string{server.FileURL("quijote.txt")}, WithConnections(4))
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+
+	for algorithm, digest := range quijoteDigests {
+		if err := dldr.Verify(algorithm, digest); err != nil {
+			t.Error(err)
+		}
+	}
+	failOnError(t, dldr.VerifyAll(quijoteDigests))
+	if err := dldr.Verify("SHA-256", "1E9BB1B16F8810E44D6D5EDE7005258518FA976719BC2ED254308E73C357CFCC"); err != nil {
+		t.Error("Algorithm names and digests should be case insensitive:", err)
+	}
+
+	wrong := map[string]string{"md5": quijoteDigests["md5"], "sha1": "wrong-hash"}
+	var checksumErr *ChecksumError
+	if err := dldr.VerifyAll(wrong); !errors.As(err, &checksumErr) || checksumErr.Algorithm != "sha1" {
+		t.Error("A wrong SHA-1 should be reported, got", err)
+	}
+	if err := dldr.Verify("whirlpool", "00"); err == nil || errors.As(err, &checksumErr) {
+		t.Error("An unknown algorithm should be reported, got", err)
+	}
+
+	RegisterHash("FNV-32a", func() hash.Hash { return fnv.New32a() })
+	if err := dldr.Verify("fnv32a", "f9add124"); err != nil {
+		t.Error("A registered algorithm should be available:", err)
+	}
+
+	// Missing files are reported instead of panicking
+	os.Remove(dldr.filename)
+	if err := dldr.Verify("sha256", quijoteDigests["sha256"]); err == nil {
+		t.Error("Verifying a missing file should fail")
+	}
+}
+
+// With inline hashes, verification doesn't read the data again
+func TestInlineHashes (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	url := server.FileURL("quijote.txt")
+
+	// A single connection writes the file in order
+	dldr := New([]string{url}, WithHashes("sha256", "md5"))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___hashFile___")
+	failOnError(t, err)
+	failOnError(t, dldr.Download(nil))
+	failOnError(t, os.Remove("___hashFile___"))
+	failOnError(t, dldr.VerifyAll(map[string]string{"sha256": quijoteDigests["sha256"], "md5": quijoteDigests["md5"]}))
+
+	// Streams are always written in order
+	dldr = New([]string{url}, WithConnections(4), WithStreamBuffer(64 << 10), WithHashes("sha512"))
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	var out bytes.Buffer
+	failOnError(t, dldr.DownloadTo(&out, nil))
+	failOnError(t, dldr.Verify("sha512", quijoteDigests["sha512"]))
+
+	// Data written out of order is read back
+	sink := NewMemorySink()
+	dldr = New([]string{url}, WithConnections(4), WithSink(sink), WithHashes("sha1"))
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	failOnError(t, dldr.Download(nil))
+	failOnError(t, dldr.Verify("sha1", quijoteDigests["sha1"]))
+}
@@ -0,0 +1,261 @@
+// Package testserver serves test fixtures over HTTP with programmable faults, so the
+// downloader can be tested offline and deterministically.
+package testserver
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Size of the blocks of a chunked body
+const chunkedBlock = 1000
+
+// Faults injected by a server. The zero value serves files correctly.
+type Faults struct {
+	DropAfter int64          // Break the connection after sending this many bytes of a body
+	DropCount int            // Number of responses to break, all of them if 0
+	BytesPerSecond int64     // Throttle every response to this bandwidth
+	ContentLengthDelta int64 // Added to the Content-Length of HEAD responses
+	IgnoreRange bool         // Answer range requests with the whole file
+	ETag string              // ETag of all files, none if empty
+	ChangingETag bool        // Send a different ETag with every response
+	ErrorStatus int          // Answer requests with this status, e.g. 429 or 503
+	ErrorCount int           // Number of requests answered with ErrorStatus, all of them if 0
+	RetryAfter string        // Retry-After header sent along with ErrorStatus
+	MaxConnections int       // Concurrent requests allowed, the rest get a 503
+	HeadStatus int           // Answer HEAD requests with this status and no headers, e.g. 405
+	Chunked bool             // Send the whole file in a chunked body, without its length, ignoring ranges
+	ChunkedCount int         // Number of GET requests answered with a chunked body, all of them if 0
+	CorruptOffset int64      // Send the byte at this offset of every file flipped, if not 0
+}
+
+// A fixtures server
+type Server struct {
+	*httptest.Server
+	dir string
+	mu sync.Mutex
+	faults Faults
+	requests int              // Requests received
+	sent int64                // Body bytes sent
+	active int                // Requests being served
+	maxActive int             // Most requests served at the same time
+	rejected int              // Requests rejected for exceeding MaxConnections
+	dropped int               // Responses broken so far
+	errors int                // Responses answered with ErrorStatus so far
+	chunked int               // Responses sent with a chunked body so far
+	ranges []string           // Range headers received with GET requests
+}
+
+// Start a server for the files in dir
+func New(dir string, faults Faults) *Server {
+	s := &Server{dir: dir, faults: faults}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// URL of a file served
+func (s *Server) FileURL(name string) string {
+	return s.URL + "/" + name
+}
+
+// Change the faults of the server
+func (s *Server) SetFaults(faults Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+	s.dropped = 0
+	s.errors = 0
+	s.chunked = 0
+}
+
+// Number of requests received
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Number of body bytes sent
+func (s *Server) Sent() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent
+}
+
+// Most requests served at the same time
+func (s *Server) MaxActive() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxActive
+}
+
+// Number of requests rejected for exceeding MaxConnections
+func (s *Server) Rejected() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejected
+}
+
+// Range headers received with GET requests, in order of arrival
+func (s *Server) Ranges() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	faults := s.faults
+	s.requests++
+	if r.Method == "GET" {
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+	}
+	limited := faults.MaxConnections > 0 && s.active >= faults.MaxConnections
+	if limited {
+		s.rejected++
+	}
+	failed := faults.ErrorStatus != 0 && (faults.ErrorCount == 0 || s.errors < faults.ErrorCount)
+	if failed {
+		s.errors++
+	}
+	drop := faults.DropAfter > 0 && r.Method == "GET" && (faults.DropCount == 0 || s.dropped < faults.DropCount)
+	if drop {
+		s.dropped++
+	}
+	chunked := faults.Chunked && r.Method == "GET" && (faults.ChunkedCount == 0 || s.chunked < faults.ChunkedCount)
+	if chunked {
+		s.chunked++
+	}
+	etag := faults.ETag
+	if faults.ChangingETag {
+		etag = fmt.Sprintf("%s%d", faults.ETag, s.requests)
+	}
+	if !limited && !failed {
+		s.active++
+		if s.active > s.maxActive {
+			s.maxActive = s.active
+		}
+		defer func() {
+			s.mu.Lock()
+			s.active--
+			s.mu.Unlock()
+		}()
+	}
+	s.mu.Unlock()
+
+	if limited {
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	if failed {
+		if faults.RetryAfter != "" {
+			w.Header().Set("Retry-After", faults.RetryAfter)
+		}
+		http.Error(w, http.StatusText(faults.ErrorStatus), faults.ErrorStatus)
+		return
+	}
+	if r.Method == "HEAD" && faults.HeadStatus != 0 {
+		w.WriteHeader(faults.HeadStatus)
+		return
+	}
+
+	name := path.Base(r.URL.Path)
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if faults.CorruptOffset > 0 && faults.CorruptOffset < int64(len(content)) {
+		content[faults.CorruptOffset] ^= 0xff
+	}
+	if etag != "" {
+		w.Header().Set("ETag", strconv.Quote(etag))
+	}
+
+	if r.Method == "HEAD" && faults.ContentLengthDelta != 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(content)) + faults.ContentLengthDelta, 10))
+		return
+	}
+
+	out := &faultyWriter{ResponseWriter: w, server: s, dropAfter: -1, bytesPerSecond: faults.BytesPerSecond}
+	if drop {
+		out.dropAfter = faults.DropAfter
+	}
+	if chunked {
+		// Flushed in small blocks, so the body is chunked and arrives gradually
+		for offset := 0; offset < len(content); offset += chunkedBlock {
+			end := offset + chunkedBlock
+			if end > len(content) {
+				end = len(content)
+			}
+			if _, err := out.Write(content[offset:end]); err != nil {
+				return
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+		return
+	}
+	if faults.IgnoreRange {
+		out.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == "GET" {
+			out.Write(content)
+		}
+		return
+	}
+	http.ServeContent(out, r, name, time.Time{}, bytes.NewReader(content))
+}
+
+// Response writer counting, throttling and breaking responses
+type faultyWriter struct {
+	http.ResponseWriter
+	server *Server
+	dropAfter int64           // Bytes to send before breaking the connection, -1 to never break it
+	bytesPerSecond int64
+}
+
+func (w *faultyWriter) Write(p []byte) (int, error) {
+	drop := false
+	if w.dropAfter >= 0 && int64(len(p)) >= w.dropAfter {
+		p = p[:w.dropAfter]
+		drop = true
+	}
+	written := 0
+	for len(p) > 0 {
+		block := p
+		if w.bytesPerSecond > 0 {
+			if size := int(w.bytesPerSecond / 100) + 1; len(block) > size {
+				block = block[:size]
+			}
+			time.Sleep(time.Duration(int64(len(block)) * int64(time.Second) / w.bytesPerSecond))
+		}
+		n, err := w.ResponseWriter.Write(block)
+		written += n
+		w.server.mu.Lock()
+		w.server.sent += int64(n)
+		w.server.mu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	if w.dropAfter >= 0 {
+		w.dropAfter -= int64(written)
+	}
+	if drop {
+		if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+	return written, nil
+}
@@ -0,0 +1,86 @@
+package testserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func get(t *testing.T, url string, rangeHeader string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func TestFaults (t *testing.T) {
+	server := New("../../test", Faults{})
+	defer server.Close()
+	url := server.FileURL("quijote.txt")
+
+	resp, body, err := get(t, url, "bytes=10-19")
+	if err != nil || resp.StatusCode != http.StatusPartialContent || len(body) != 10 {
+		t.Error("Ranges should be served by default")
+	}
+
+	server.SetFaults(Faults{IgnoreRange: true})
+	resp, body, err = get(t, url, "bytes=10-19")
+	if err != nil || resp.StatusCode != http.StatusOK || len(body) != 317621 {
+		t.Error("Ranges should be ignored")
+	}
+
+	server.SetFaults(Faults{DropAfter: 1000, DropCount: 1})
+	if _, body, err = get(t, url, ""); err == nil || len(body) != 1000 {
+		t.Error("The connection should break after 1000 bytes, got", len(body), err)
+	}
+	if _, body, err = get(t, url, ""); err != nil || len(body) != 317621 {
+		t.Error("Only one connection should break")
+	}
+
+	server.SetFaults(Faults{ErrorStatus: http.StatusTooManyRequests, ErrorCount: 1, RetryAfter: "3"})
+	resp, _, err = get(t, url, "")
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "3" {
+		t.Error("The first request should be rejected")
+	}
+	if resp, _, err = get(t, url, ""); err != nil || resp.StatusCode != http.StatusOK {
+		t.Error("The second request should be served")
+	}
+
+	server.SetFaults(Faults{HeadStatus: http.StatusMethodNotAllowed})
+	if resp, err := http.Head(url); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("HEAD requests should be refused")
+	}
+
+	server.SetFaults(Faults{Chunked: true, ChunkedCount: 1})
+	resp, body, err = get(t, url, "bytes=10-19")
+	if err != nil || resp.StatusCode != http.StatusOK || resp.ContentLength != -1 || len(body) != 317621 {
+		t.Error("The whole file should be sent without its length")
+	}
+	if resp, _, err = get(t, url, "bytes=10-19"); err != nil || resp.StatusCode != http.StatusPartialContent {
+		t.Error("Only one body should be chunked")
+	}
+
+	server.SetFaults(Faults{CorruptOffset: 15})
+	reference, _ := ioutil.ReadFile("../../test/quijote.txt")
+	if _, body, err = get(t, url, "bytes=10-19"); err != nil || len(body) != 10 || body[5] != reference[15] ^ 0xff ||
+		string(body[:5]) != string(reference[10:15]) {
+		t.Error("The byte at the offset should be corrupt")
+	}
+
+	server.SetFaults(Faults{ETag: "v", ChangingETag: true})
+	resp1, _, _ := get(t, url, "")
+	resp2, _, _ := get(t, url, "")
+	if resp1.Header.Get("ETag") == resp2.Header.Get("ETag") {
+		t.Error("The ETag should change with every response")
+	}
+}
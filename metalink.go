@@ -0,0 +1,228 @@
+package multipartdownloader
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const maxMetalinkSize = 16 << 20
+
+// Description of the files of a Metalink document, version 4 (RFC 5854) or 3
+type Metalink struct {
+	Files []MetalinkFile
+}
+
+// A file described by a Metalink document
+type MetalinkFile struct {
+	Name string             // Name of the file, without any directory
+	Size int64              // Size of the file, -1 if unknown
+	Hashes []Checksum       // Digests of the whole file, of the algorithms known by Verify
+	Pieces *PieceHashes     // Digests of the pieces of the file, nil if none
+	Mirrors []Mirror        // HTTP sources, by priority
+}
+
+// A source of a file
+type Mirror struct {
+	URL string
+	Priority int            // Preference of the mirror, from 1 (most preferred) to 999999
+	Location string         // ISO 3166-1 country code of the mirror, if known
+}
+
+// XML elements of both Metalink versions. Version 3 nests hashes and pieces in
+// <verification> and urls in <resources>, inside a <files> element.
+type metalinkXML struct {
+	Files []metalinkFileXML      `xml:"file"`
+	FilesV3 []metalinkFileXML    `xml:"files>file"`
+}
+
+type metalinkFileXML struct {
+	Name string                   `xml:"name,attr"`
+	Size string                   `xml:"size"`
+	Hashes []metalinkHashXML      `xml:"hash"`
+	Pieces []metalinkPiecesXML    `xml:"pieces"`
+	URLs []metalinkURLXML         `xml:"url"`
+	HashesV3 []metalinkHashXML    `xml:"verification>hash"`
+	PiecesV3 []metalinkPiecesXML  `xml:"verification>pieces"`
+	URLsV3 []metalinkURLXML       `xml:"resources>url"`
+}
+
+type metalinkHashXML struct {
+	Type string   `xml:"type,attr"`
+	Value string  `xml:",chardata"`
+}
+
+type metalinkPiecesXML struct {
+	Type string                `xml:"type,attr"`
+	Length int64               `xml:"length,attr"`
+	Hashes []metalinkHashXML   `xml:"hash"`
+}
+
+type metalinkURLXML struct {
+	Location string    `xml:"location,attr"`
+	Priority int       `xml:"priority,attr"`
+	Preference int     `xml:"preference,attr"`   // Version 3: from 100 (most preferred) to 0
+	Value string       `xml:",chardata"`
+}
+
+// Parse a Metalink document
+//
+// Only HTTP and HTTPS mirrors are kept, and only hashes of algorithms known by Verify.
+func ParseMetalink(data []byte) (*Metalink, error) {
+	var doc metalinkXML
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Invalid Metalink document: %v", err)
+	}
+	metalink := &Metalink{}
+	for _, f := range append(doc.Files, doc.FilesV3...) {
+		file := MetalinkFile{Name: cleanFilename(f.Name), Size: -1}
+		if f.Size != "" {
+			if _, err := fmt.Sscan(f.Size, &file.Size); err != nil {
+				return nil, fmt.Errorf("Invalid size of %s in Metalink document: %q", f.Name, f.Size)
+			}
+		}
+
+		for _, h := range append(f.Hashes, f.HashesV3...) {
+			algorithm := normalizeAlgorithm(h.Type)
+			if _, err := newHash(algorithm); err == nil {
+				file.Hashes = append(file.Hashes, Checksum{algorithm, strings.ToLower(strings.TrimSpace(h.Value))})
+			}
+		}
+
+		for _, p := range append(f.Pieces, f.PiecesV3...) {
+			algorithm := normalizeAlgorithm(p.Type)
+			if _, err := newHash(algorithm); err != nil || file.Pieces != nil {
+				continue
+			}
+			file.Pieces = &PieceHashes{Algorithm: algorithm, Length: p.Length}
+			for _, h := range p.Hashes {
+				file.Pieces.Digests = append(file.Pieces.Digests, strings.TrimSpace(h.Value))
+			}
+		}
+
+		for _, u := range f.URLs {
+			file.addMirror(u.Value, u.Priority, u.Location)
+		}
+		for _, u := range f.URLsV3 {
+			// Version 3 preferences go the other way round
+			priority := 0
+			if u.Preference > 0 {
+				priority = 101 - u.Preference
+			}
+			file.addMirror(u.Value, priority, u.Location)
+		}
+		// Mirrors without priority come last
+		sort.SliceStable(file.Mirrors, func(i, j int) bool {
+			pi, pj := file.Mirrors[i].Priority, file.Mirrors[j].Priority
+			return pi != 0 && (pj == 0 || pi < pj)
+		})
+
+		if file.Name == "" {
+			return nil, fmt.Errorf("Metalink document has a file without a valid name: %q", f.Name)
+		}
+		metalink.Files = append(metalink.Files, file)
+	}
+	if len(metalink.Files) == 0 {
+		return nil, errors.New("Metalink document has no files")
+	}
+	return metalink, nil
+}
+
+// Internal: add a mirror, if it can be downloaded from
+func (file *MetalinkFile) addMirror(url string, priority int, location string) {
+	url = strings.TrimSpace(url)
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return
+	}
+	file.Mirrors = append(file.Mirrors, Mirror{url, priority, strings.ToLower(location)})
+}
+
+// Get the URLs of the mirrors, most preferred first
+func (file *MetalinkFile) URLs() []string {
+	urls := make([]string, len(file.Mirrors))
+	for i, m := range file.Mirrors {
+		urls[i] = m.URL
+	}
+	return urls
+}
+
+// Get the strongest of the digests of the file, nil if there is none
+func (file *MetalinkFile) Checksum() *Checksum {
+	for _, algorithm := range []string{"sha512", "blake2b", "sha256", "sha1", "md5"} {
+		for _, h := range file.Hashes {
+			if h.Algorithm == algorithm {
+				return &Checksum{h.Algorithm, h.Digest}
+			}
+		}
+	}
+	if len(file.Hashes) > 0 {
+		return &file.Hashes[0]
+	}
+	return nil
+}
+
+// Create a downloader for a file of a Metalink document, using all its mirrors. Its piece
+// hashes are verified while downloading, and its strongest digest is computed while
+// downloading if possible, for Verify. Mirrors failing or disagreeing with its size or
+// digest are left out. More options can be given.
+func NewFromMetalink(file *MetalinkFile, options ...Option) *MultiDownloader {
+	metalinkOptions := []Option{WithQuorum(1)}
+	if file.Pieces != nil {
+		metalinkOptions = append(metalinkOptions, WithPieceHashes(file.Pieces))
+	}
+	if file.Size >= 0 {
+		metalinkOptions = append(metalinkOptions, WithExpectedSize(file.Size))
+	}
+	if checksum := file.Checksum(); checksum != nil {
+		metalinkOptions = append(metalinkOptions, WithExpectedChecksum(*checksum))
+	}
+	return New(file.URLs(), append(metalinkOptions, options...)...)
+}
+
+// Load a Metalink document from a local path or an HTTP URL. The HTTP client, User-Agent
+// and timeout are taken from the options, as for a downloader.
+func LoadMetalink(location string, options ...Option) (*Metalink, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		data, err := ioutil.ReadFile(location)
+		if err != nil {
+			return nil, err
+		}
+		return ParseMetalink(data)
+	}
+
+	dldr := New(nil, options...)
+	ctx, cancel := context.WithTimeout(context.Background(), dldr.timeout)
+	defer cancel()
+	req, err := dldr.newRequest(ctx, "GET", location)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := dldr.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, newStatusError(location, resp)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMetalinkSize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseMetalink(data)
+}
+
+// Whether a path or URL looks like a Metalink document
+func IsMetalink(location string) bool {
+	location = strings.ToLower(location)
+	if i := strings.IndexAny(location, "?#"); i >= 0 {
+		location = location[:i]
+	}
+	return strings.HasSuffix(location, ".meta4") || strings.HasSuffix(location, ".metalink")
+}
@@ -0,0 +1,183 @@
+package multipartdownloader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+const metalinkV4 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <published>2009-05-15T12:23:23Z</published>
+  <file name="dir/quijote.txt">
+    <size>317621</size>
+    <identity>El Quijote</identity>
+    <hash type="md5">45bb5fc96bb4c67778d288fba98eee48</hash>
+    <hash type="sha-256">1e9bb1b16f8810e44d6d5ede7005258518fa976719bc2ed254308e73c357cfcc</hash>
+    <hash type="unknown">00</hash>
+    <pieces length="262144" type="sha-1">
+      <hash>aaaa</hash>
+      <hash>bbbb</hash>
+    </pieces>
+    <url location="es" priority="2">%s</url>
+    <url>http://example.com/quijote.txt</url>
+    <url location="de" priority="1">%s</url>
+    <url priority="1">ftp://ftp.example.com/quijote.txt</url>
+    <metaurl mediatype="torrent">http://example.com/quijote.torrent</metaurl>
+  </file>
+  <file name="quijote2.txt">
+    <url>http://example.com/quijote2.txt</url>
+  </file>
+</metalink>`
+
+const metalinkV3 = `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="quijote.txt">
+      <size>317621</size>
+      <verification>
+        <hash type="sha1">e10ddbc97ae8104b77a2006e5d2d017fc04ecd27</hash>
+        <pieces length="262144" type="sha1">
+          <hash piece="0">aaaa</hash>
+          <hash piece="1">bbbb</hash>
+        </pieces>
+      </verification>
+      <resources>
+        <url type="http" location="us" preference="10">http://slow.example.com/quijote.txt</url>
+        <url type="http" location="fr" preference="100">http://fast.example.com/quijote.txt</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`
+
+func TestParseMetalink (t *testing.T) {
+	metalink, err := ParseMetalink([]byte(fmt.Sprintf(metalinkV4, "http://es.example.com/q", "https://de.example.com/q")))
+	failOnError(t, err)
+	if len(metalink.Files) != 2 {
+		t.Fatal("Two files expected, got", len(metalink.Files))
+	}
+	file := metalink.Files[0]
+	if file.Name != "quijote.txt" || file.Size != 317621 {
+		t.Error("Wrong name or size:", file.Name, file.Size)
+	}
+	if len(file.Hashes) != 2 || file.Checksum().Algorithm != "sha256" {
+		t.Error("The known hashes should be kept, the strongest first, got", file.Hashes)
+	}
+	if file.Pieces == nil || file.Pieces.Algorithm != "sha1" || file.Pieces.Length != 262144 ||
+		strings.Join(file.Pieces.Digests, ",") != "aaaa,bbbb" {
+		t.Error("Wrong pieces:", file.Pieces)
+	}
+	urls := file.URLs()
+	if strings.Join(urls, " ") != "https://de.example.com/q http://es.example.com/q http://example.com/quijote.txt" {
+		t.Error("The HTTP mirrors should be sorted by priority, got", urls)
+	}
+	if file.Mirrors[0].Location != "de" || file.Mirrors[0].Priority != 1 {
+		t.Error("Wrong mirror:", file.Mirrors[0])
+	}
+	if metalink.Files[1].Size != -1 {
+		t.Error("An unknown size should be -1")
+	}
+
+	metalink, err = ParseMetalink([]byte(metalinkV3))
+	failOnError(t, err)
+	file = metalink.Files[0]
+	if file.Size != 317621 || file.Checksum().Digest != quijoteDigests["sha1"] || len(file.Pieces.Digests) != 2 {
+		t.Error("Wrong version 3 file:", file)
+	}
+	if urls := file.URLs(); urls[0] != "http://fast.example.com/quijote.txt" || file.Mirrors[0].Location != "fr" {
+		t.Error("Version 3 preferences should be turned into priorities, got", urls)
+	}
+
+	// Names are only kept as safe file names
+	metalink, err = ParseMetalink([]byte(`<metalink><file name="../dir/qui&#9;jote.txt "/></metalink>`))
+	failOnError(t, err)
+	if name := metalink.Files[0].Name; name != "quijote.txt" {
+		t.Error("The name should be sanitized, got", name)
+	}
+
+	for _, doc := range []string{"", "<metalink/>", "<html></html>", `<metalink><file name=""/></metalink>`,
+		`<metalink><file name=".."/></metalink>`, `<metalink><file name="dir/.."/></metalink>`,
+		`<metalink><file name=" &#9; "/></metalink>`} {
+		if _, err := ParseMetalink([]byte(doc)); err == nil {
+			t.Error("Parsing", doc, "should fail")
+		}
+	}
+}
+
+func TestMetalinkDownload (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	server1 := testserver.New("test", testserver.Faults{})
+	defer server1.Close()
+	server2 := testserver.New("test", testserver.Faults{})
+	defer server2.Close()
+
+	// Real pieces, served along with the document
+	pieces := sha1Pieces(reference, 262144)
+	doc := strings.Replace(fmt.Sprintf(metalinkV4, server1.FileURL("quijote.txt"), server2.FileURL("quijote.txt")),
+		"<hash>aaaa</hash>\n      <hash>bbbb</hash>",
+		"<hash>" + pieces.Digests[0] + "</hash><hash>" + pieces.Digests[1] + "</hash>", 1)
+	doc = strings.Replace(doc, "<url>http://example.com/quijote.txt</url>", "", 1)
+	dir, err := ioutil.TempDir("", "metalink")
+	failOnError(t, err)
+	defer os.RemoveAll(dir)
+	failOnError(t, ioutil.WriteFile(filepath.Join(dir, "quijote.meta4"), []byte(doc), 0666))
+	docServer := testserver.New(dir, testserver.Faults{})
+	defer docServer.Close()
+
+	for _, location := range []string{filepath.Join(dir, "quijote.meta4"), docServer.FileURL("quijote.meta4")} {
+		if !IsMetalink(location) {
+			t.Error(location, "should be recognized as a Metalink document")
+		}
+		metalink, err := LoadMetalink(location)
+		failOnError(t, err)
+		file := &metalink.Files[0]
+		dldr := NewFromMetalink(file, WithConnections(4))
+		_, err = dldr.GatherInfo()
+		failOnError(t, err)
+		_, err = dldr.SetupFile("___metalinkFile___")
+		failOnError(t, err)
+		failOnError(t, dldr.Download(nil))
+		compareElQuijote(t, "___metalinkFile___")
+		checksum := file.Checksum()
+		failOnError(t, dldr.Verify(checksum.Algorithm, checksum.Digest))
+		os.Remove("___metalinkFile___")
+		if server1.Requests() == 0 || server2.Requests() == 0 {
+			t.Error("All mirrors should be used")
+		}
+	}
+}
+
+// Documents are loaded with the client, User-Agent and timeout of the options
+func TestLoadMetalinkOptions (t *testing.T) {
+	doc := fmt.Sprintf(metalinkV4, "http://es.example.com/q", "https://de.example.com/q")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.UserAgent() != "godl-test/1.0" {
+			http.Error(w, "Unexpected User-Agent", http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/slow.meta4" {
+			time.Sleep(500 * time.Millisecond)
+		}
+		w.Write([]byte(doc))
+	}))
+	defer server.Close()
+
+	_, err := LoadMetalink(server.URL + "/file.meta4", WithUserAgent("godl-test/1.0"), WithHTTPClient(server.Client()))
+	failOnError(t, err)
+	if _, err := LoadMetalink(server.URL + "/file.meta4"); err == nil {
+		t.Error("The User-Agent should be given by the options")
+	}
+	if _, err := LoadMetalink(server.URL + "/slow.meta4", WithUserAgent("godl-test/1.0"),
+		WithTimeout(50 * time.Millisecond)); err == nil {
+		t.Error("The timeout should be given by the options")
+	}
+}
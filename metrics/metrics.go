@@ -0,0 +1,216 @@
+// Prometheus metrics of downloads
+//
+// The metrics are gathered from the events and statistics of the downloaders being watched,
+// so the downloader itself doesn't depend on Prometheus:
+//
+//     collector := metrics.New()
+//     prometheus.MustRegister(collector)
+//     stop := collector.Watch(dldr)
+//     defer stop()
+//
+// Events are dropped rather than stalling a download, if the collector can't keep up with
+// them. The number of dropped events is exported too, as the metrics miss them. The bytes
+// downloaded and the active connections are taken from the statistics whenever the metrics
+// are collected, so they are up to date while downloading.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	md "github.com/alvatar/multipart-downloader"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const eventBuffer = 4096
+
+// Metrics of all the downloads watched
+type Collector struct {
+	bytes *prometheus.CounterVec           // Bytes downloaded, by source host
+	latency *prometheus.HistogramVec       // Time from range requests to their responses, by source host
+	retries *prometheus.CounterVec         // Chunks requested again after a failure, by source host
+	errors *prometheus.CounterVec          // Range requests that failed, by source host
+	verificationFailures *prometheus.CounterVec // Digests that didn't match, by algorithm
+	activeConnections prometheus.GaugeFunc // Range requests in progress
+	droppedEvents prometheus.CounterFunc   // Events missed by the metrics
+	mu sync.Mutex
+	dropped int64                          // Events dropped by finished watches
+	watches map[*watch]bool                // Watches in progress
+}
+
+// A downloader being watched
+type watch struct {
+	dldr *md.MultiDownloader
+	subscription *md.Subscription
+	started time.Time                      // Start of the download being counted
+	counted map[string]int64               // Bytes of each source of that download already counted
+}
+
+// Create a collector, to be registered in a Prometheus registry
+func New() *Collector {
+	c := &Collector{
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "godl_downloaded_bytes_total",
+			Help: "Bytes downloaded, by source host.",
+		}, []string{"host"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "godl_range_request_latency_seconds",
+			Help: "Time from range requests to their responses, by source host.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		}, []string{"host"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "godl_retries_total",
+			Help: "Chunks requested again after a failure, by source host.",
+		}, []string{"host"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "godl_range_request_errors_total",
+			Help: "Range requests that failed, not counting stopped downloads, by source host.",
+		}, []string{"host"}),
+		verificationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "godl_verification_failures_total",
+			Help: "Downloaded files whose digest didn't match, by algorithm.",
+		}, []string{"algorithm"}),
+		watches: make(map[*watch]bool),
+	}
+	c.activeConnections = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "godl_active_connections",
+		Help: "Range requests in progress.",
+	}, c.activeCount)
+	c.droppedEvents = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "godl_dropped_events_total",
+		Help: "Download events missed by the metrics, as they arrived faster than they were counted.",
+	}, c.droppedCount)
+	return c
+}
+
+// Describe the metrics, as a prometheus.Collector
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, metric := range c.metrics() {
+		metric.Describe(ch)
+	}
+}
+
+// Collect the metrics, as a prometheus.Collector
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	for w := range c.watches {
+		c.countBytes(w)
+	}
+	c.mu.Unlock()
+	for _, metric := range c.metrics() {
+		metric.Collect(ch)
+	}
+}
+
+// Gather the metrics of a downloader, until the returned function is called. The metrics
+// of its events are all counted by the time the function returns.
+func (c *Collector) Watch(dldr *md.MultiDownloader) (stop func()) {
+	subscription := dldr.Subscribe(eventBuffer)
+	w := &watch{dldr: dldr, subscription: subscription, counted: make(map[string]int64)}
+	c.mu.Lock()
+	c.watches[w] = true
+	c.mu.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		for event := range subscription.Events() {
+			c.count(event)
+		}
+		close(done)
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			subscription.Unsubscribe()
+			<-done
+			c.mu.Lock()
+			c.countBytes(w)
+			delete(c.watches, w)
+			c.dropped += subscription.Dropped()
+			c.mu.Unlock()
+		})
+	}
+}
+
+// Internal: update the metrics with an event
+func (c *Collector) count(event md.Event) {
+	switch event.Kind {
+	case md.EventChunkCompleted, md.EventChunkFailed:
+		host := hostOf(event.URL)
+		if event.Latency > 0 {
+			c.latency.WithLabelValues(host).Observe(event.Latency.Seconds())
+		}
+		// Stopped downloads aren't failures of the sources
+		if event.Kind == md.EventChunkFailed && !errors.Is(event.Err, context.Canceled) &&
+			!errors.Is(event.Err, context.DeadlineExceeded) {
+			c.errors.WithLabelValues(host).Inc()
+		}
+	case md.EventChunkRetried:
+		c.retries.WithLabelValues(hostOf(event.URL)).Inc()
+	case md.EventVerificationFinished:
+		if _, ok := event.Err.(*md.ChecksumError); ok {
+			c.verificationFailures.WithLabelValues(event.Algorithm).Inc()
+		}
+	}
+}
+
+// Internal: add the bytes received from each source since they were last counted. The
+// collector must be locked.
+func (c *Collector) countBytes(w *watch) {
+	stats := w.dldr.Stats()
+	// The statistics start again with every download
+	if !stats.Started.Equal(w.started) {
+		w.started = stats.Started
+		w.counted = make(map[string]int64)
+	}
+	for _, source := range stats.Sources {
+		if n := source.Bytes - w.counted[source.URL]; n > 0 {
+			c.bytes.WithLabelValues(hostOf(source.URL)).Add(float64(n))
+			w.counted[source.URL] = source.Bytes
+		}
+	}
+}
+
+// Internal: connections downloading from a source, in all watches
+func (c *Collector) activeCount() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := 0
+	for w := range c.watches {
+		for _, conn := range w.dldr.Stats().Connections {
+			if conn.URL != "" {
+				active++
+			}
+		}
+	}
+	return float64(active)
+}
+
+// Internal: events dropped so far by all watches
+func (c *Collector) droppedCount() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := c.dropped
+	for w := range c.watches {
+		dropped += w.subscription.Dropped()
+	}
+	return float64(dropped)
+}
+
+func (c *Collector) metrics() []prometheus.Collector {
+	return []prometheus.Collector{c.bytes, c.latency, c.retries, c.errors, c.verificationFailures,
+		c.activeConnections, c.droppedEvents}
+}
+
+// Internal: the host of a source, the label of its metrics
+func hostOf(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return "unknown"
+	}
+	return u.Host
+}
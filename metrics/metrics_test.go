@@ -0,0 +1,222 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	md "github.com/alvatar/multipart-downloader"
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	dropping := testserver.New("../test", testserver.Faults{DropAfter: 1000, DropCount: 1})
+	defer dropping.Close()
+
+	collector := New()
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := md.DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	urls := []string{server.FileURL("quijote.txt"), dropping.FileURL("quijote.txt")}
+	dldr := md.New(urls, md.WithConnections(2), md.WithChunkSize(1 << 15), md.WithRetryPolicy(policy))
+	stop := collector.Watch(dldr)
+	if _, err := dldr.GatherInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dldr.SetupFile("___metricsFile___"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("___metricsFile___")
+	if err := dldr.Download(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := dldr.Verify("md5", "00000000000000000000000000000000"); err == nil {
+		t.Error("The wrong digest should not match")
+	}
+	stop()
+
+	stat, err := os.Stat("../test/quijote.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytes, retries := 0.0, 0.0
+	for _, source := range urls {
+		u, _ := url.Parse(source)
+		bytes += testutil.ToFloat64(collector.bytes.WithLabelValues(u.Host))
+		retries += testutil.ToFloat64(collector.retries.WithLabelValues(u.Host))
+	}
+	if bytes != float64(stat.Size()) {
+		t.Error("The bytes of the file should be counted, got", bytes)
+	}
+	droppingURL, _ := url.Parse(dropping.URL)
+	if errors := testutil.ToFloat64(collector.errors.WithLabelValues(droppingURL.Host)); errors != 1 || retries == 0 {
+		t.Error("The failed request should be counted and retried, got", errors, "errors and", retries, "retries")
+	}
+	if failures := testutil.ToFloat64(collector.verificationFailures.WithLabelValues("md5")); failures != 1 {
+		t.Error("The verification failure should be counted, got", failures)
+	}
+	if active := testutil.ToFloat64(collector.activeConnections); active != 0 {
+		t.Error("No connections should be active, got", active)
+	}
+	if dropped := testutil.ToFloat64(collector.droppedEvents); dropped != 0 {
+		t.Error("No events should be dropped, got", dropped)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	if !strings.Contains(strings.Join(names, " "), "godl_range_request_latency_seconds") {
+		t.Error("The latency of the requests should be exported, got", names)
+	}
+}
+
+// The bytes and active connections are exported while downloading
+func TestMetricsWhileDownloading (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{BytesPerSecond: 100 << 10})
+	defer server.Close()
+	collector := New()
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+
+	dldr := md.New([]string{server.FileURL("quijote.txt")}, md.WithConnections(2))
+	stop := collector.Watch(dldr)
+	defer stop()
+	if _, err := dldr.GatherInfo(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dldr.SetupFile("___metricsFile___"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("___metricsFile___")
+	done := make(chan error)
+	go func() {
+		done <- dldr.Download(nil)
+	}()
+
+	u, _ := url.Parse(server.URL)
+	bytes, active := 0.0, 0.0
+	for start := time.Now(); time.Since(start) < 5 * time.Second && (bytes == 0 || active == 0); time.Sleep(20 * time.Millisecond) {
+		if _, err := registry.Gather(); err != nil {
+			t.Fatal(err)
+		}
+		bytes = testutil.ToFloat64(collector.bytes.WithLabelValues(u.Host))
+		active = testutil.ToFloat64(collector.activeConnections)
+	}
+	if bytes == 0 || bytes >= 317621 || active < 1 || active > 2 {
+		t.Error("The bytes and connections should be exported while downloading, got", bytes, "bytes and", active, "connections")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if active := testutil.ToFloat64(collector.activeConnections); active != 0 {
+		t.Error("No connections should be active once done, got", active)
+	}
+}
+
+// The bytes of every download are counted, however many were received before a scrape
+func TestMetricsSeveralDownloads (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	collector := New()
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+
+	dldr := md.New([]string{server.FileURL("quijote.txt")}, md.WithConnections(2))
+	stop := collector.Watch(dldr)
+	defer stop()
+	defer os.Remove("___metricsFile___")
+	u, _ := url.Parse(server.URL)
+	for n := 1; n <= 2; n++ {
+		if _, err := dldr.GatherInfo(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dldr.SetupFile("___metricsFile___"); err != nil {
+			t.Fatal(err)
+		}
+		if err := dldr.Download(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := registry.Gather(); err != nil {
+			t.Fatal(err)
+		}
+		if bytes := testutil.ToFloat64(collector.bytes.WithLabelValues(u.Host)); bytes != float64(n * 317621) {
+			t.Error("The bytes of", n, "downloads should be counted, got", bytes)
+		}
+	}
+}
+
+// Scraping while the chunks table is being built doesn't race with it
+func TestMetricsWhileGatheringInfo (t *testing.T) {
+	server := testserver.New("../test", testserver.Faults{})
+	defer server.Close()
+	collector := New()
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+
+	dldr := md.New([]string{server.FileURL("quijote.txt")}, md.WithConnections(4))
+	stop := collector.Watch(dldr)
+	defer stop()
+	done := make(chan bool)
+	scraped := make(chan bool)
+	go func() {
+		defer close(scraped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := registry.Gather(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, err := dldr.GatherInfo(); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	<-scraped
+}
+
+// Stopped downloads don't count as errors of the sources
+func TestMetricsStoppedErrors (t *testing.T) {
+	collector := New()
+	source := "http://example.com/file"
+	for _, err := range []error{context.Canceled, context.DeadlineExceeded, &md.CanceledError{Err: context.DeadlineExceeded}} {
+		collector.count(md.Event{Kind: md.EventChunkFailed, URL: source, Err: err})
+	}
+	if errors := testutil.ToFloat64(collector.errors.WithLabelValues("example.com")); errors != 0 {
+		t.Error("Stopped downloads shouldn't be counted as errors, got", errors)
+	}
+	collector.count(md.Event{Kind: md.EventChunkFailed, URL: source, Err: io.ErrUnexpectedEOF})
+	if errors := testutil.ToFloat64(collector.errors.WithLabelValues("example.com")); errors != 1 {
+		t.Error("The failed request should be counted, got", errors)
+	}
+}
@@ -0,0 +1,205 @@
+package multipartdownloader
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// A setting of the downloader, see New
+type Option func(*MultiDownloader)
+
+// Create a downloader for a file available at the given URLs
+//
+// Without options, a single connection is used with a 5 seconds timeout for probing the
+// sources, data is copied in 4 KiB blocks to a ".part" file and logging is only enabled
+// by SetVerbose.
+func New(urls []string, options ...Option) *MultiDownloader {
+	dldr := &MultiDownloader{
+		urls: urls,
+		nConns: 1,
+		timeout: defaultTimeout,
+		client: &http.Client{},
+		bufferSize: fileWriteChunk,
+		partSuffix: tmpFileSuffix,
+		retryPolicy: DefaultRetryPolicy(),
+		streamBuffer: defaultStreamBuffer,
+		expectedSize: -1,
+		rateLimiter: NewRateLimiter(0),
+	}
+	for _, option := range options {
+		option(dldr)
+	}
+	return dldr
+}
+
+// Maximum number of concurrent connections. Values below 1 are ignored.
+func WithConnections(nConns int) Option {
+	return func(dldr *MultiDownloader) {
+		if nConns > 0 {
+			dldr.nConns = nConns
+		}
+	}
+}
+
+// Timeout for probing the sources. Range requests are not limited, as they can
+// legitimately take a long time.
+func WithTimeout(timeout time.Duration) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.timeout = timeout
+	}
+}
+
+// HTTP client used for all requests, e.g. to set up proxies, TLS or cookies
+func WithHTTPClient(client *http.Client) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.client = client
+	}
+}
+
+// Maximum size of the chunks the file is initially divided into. By default, there
+// are a few chunks per connection.
+func WithChunkSize(size int64) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.chunkSize = size
+	}
+}
+
+// Size of the buffer used to copy data from each connection to the file. Values below 1
+// are ignored.
+func WithBufferSize(size int) Option {
+	return func(dldr *MultiDownloader) {
+		if size > 0 {
+			dldr.bufferSize = size
+		}
+	}
+}
+
+// Suffix appended to the output filename while the download is incomplete
+func WithPartSuffix(suffix string) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.partSuffix = suffix
+	}
+}
+
+// Logger for verbose and error output. Verbose output is enabled when a logger is set.
+func WithLogger(logger *log.Logger) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.logger = logger
+	}
+}
+
+// Maximum concurrent connections to a host, given as "name" or "name:port". All sources on
+// the host share them. Limits of other hosts are learnt when they refuse connections.
+func WithHostLimit(host string, maxConns int) Option {
+	return func(dldr *MultiDownloader) {
+		if dldr.hostLimits == nil {
+			dldr.hostLimits = make(map[string]int)
+		}
+		dldr.hostLimits[host] = maxConns
+	}
+}
+
+// Total bandwidth limit in bytes per second, across all connections
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.rateLimiter = NewRateLimiter(bytesPerSecond)
+	}
+}
+
+// Total bandwidth limit shared with other downloaders using the same limiter. SetRateLimit
+// then changes the limit of all of them.
+func WithRateLimiter(limiter *RateLimiter) Option {
+	return func(dldr *MultiDownloader) {
+		if limiter != nil {
+			dldr.rateLimiter = limiter
+		}
+	}
+}
+
+// Take the connections from a budget shared with other downloaders, as done by Queue
+func WithConnectionBudget(budget *ConnectionBudget) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.connBudget = budget
+	}
+}
+
+// Bandwidth limit of each source in bytes per second
+func WithSourceRateLimit(bytesPerSecond int64) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.sourceRate = bytesPerSecond
+	}
+}
+
+// Storage the data is written to instead of a local file, see Sink
+func WithSink(sink Sink) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.sink = sink
+	}
+}
+
+// Verify each piece of the file as it is downloaded, fetching corrupt pieces again from
+// another source. Data is only written once its piece is verified, also with DownloadTo.
+func WithPieceHashes(pieces *PieceHashes) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.pieceHashes = pieces
+	}
+}
+
+// Compute digests while downloading, so Verify doesn't need to read the file again. It
+// works with DownloadTo, and with Download when the data is written in order, as with a
+// single connection. Otherwise Verify reads the file.
+func WithHashes(algorithms ...string) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.hashAlgorithms = append(dldr.hashAlgorithms, algorithms...)
+	}
+}
+
+// Tolerate sources failing or disagreeing on the file, as long as at least quorum sources
+// agree: the largest group of agreeing sources is downloaded from, and the others are left
+// out, see ExcludedSources. By default, all sources have to agree.
+func WithQuorum(quorum int) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.quorum = quorum
+	}
+}
+
+// Only download from sources telling this length, or not telling any, leaving out the others.
+// Failing sources are left out too, as with WithQuorum.
+func WithExpectedSize(size int64) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.expectedSize = size
+	}
+}
+
+// Leave out the sources advertising a different digest of the file, in Digest, Repr-Digest
+// or X-Goog-Hash headers. Failing sources are left out too, as with WithQuorum. The digest
+// is computed while downloading as with WithHashes, but it has to be checked with Verify.
+func WithExpectedChecksum(checksum Checksum) Option {
+	return func(dldr *MultiDownloader) {
+		checksum.Algorithm = normalizeAlgorithm(checksum.Algorithm)
+		dldr.expectedChecksum = &checksum
+		dldr.hashAlgorithms = append(dldr.hashAlgorithms, checksum.Algorithm)
+	}
+}
+
+// Maximum memory used by DownloadTo to hold data received ahead of the writer
+func WithStreamBuffer(size int64) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.streamBuffer = size
+	}
+}
+
+// Policy for retrying failed requests, DefaultRetryPolicy() if not set
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.retryPolicy = policy
+	}
+}
+
+// User-Agent header sent with every request
+func WithUserAgent(userAgent string) Option {
+	return func(dldr *MultiDownloader) {
+		dldr.userAgent = userAgent
+	}
+}
@@ -0,0 +1,89 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+func TestOptions (t *testing.T) {
+	var mu sync.Mutex
+	userAgents := map[string]bool{}
+	fileServer := http.FileServer(http.Dir("test"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents[r.UserAgent()] = true
+		mu.Unlock()
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	var logOutput bytes.Buffer
+	dldr := New([]string{server.URL + "/quijote.txt"},
+		WithConnections(3),
+		WithChunkSize(1 << 15),
+		WithHTTPClient(server.Client()),
+		WithBufferSize(100),
+		WithPartSuffix(".incomplete"),
+		WithLogger(log.New(&logOutput, "", 0)),
+		WithUserAgent("godl-test/1.0"))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	if len(dldr.Chunks()) != 10 {
+		t.Error("The chunk size should determine the chunks")
+	}
+	_, err = dldr.SetupFile("")
+	failOnError(t, err)
+	if dldr.partFilename != "quijote.txt.incomplete" {
+		t.Error("Unexpected part filename", dldr.partFilename)
+	}
+	err = dldr.Download(nil)
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	result, err := ioutil.ReadFile(dldr.filename)
+	failOnError(t, err)
+	if !bytes.Equal(reference, result) {
+		t.Error("Downloaded file does not match the reference file")
+	}
+	if len(userAgents) != 1 || !userAgents["godl-test/1.0"] {
+		t.Error("All requests should carry the configured User-Agent, got", userAgents)
+	}
+	if !strings.Contains(logOutput.String(), "File length: 317621 bytes") {
+		t.Error("Verbose output should go to the configured logger")
+	}
+}
+
+// Non-positive sizes keep the defaults, instead of stalling or panicking
+func TestOptionsInvalid (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	for _, options := range [][]Option{
+		{WithConnections(0)},
+		{WithConnections(-2)},
+		{WithBufferSize(0)},
+		{WithBufferSize(-1)},
+	} {
+		dldr := New([]string{server.FileURL("quijote.txt")}, options...)
+		if dldr.nConns != 1 || dldr.bufferSize != fileWriteChunk {
+			t.Error("Invalid options should be ignored, got", dldr.nConns, dldr.bufferSize)
+		}
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+		_, err = dldr.SetupFile("___invalidOptionsFile___")
+		failOnError(t, err)
+		failOnError(t, dldr.Download(nil))
+		compareElQuijote(t, dldr.filename)
+		os.Remove(dldr.filename)
+	}
+}
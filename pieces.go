@@ -0,0 +1,102 @@
+package multipartdownloader
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Expected digests of consecutive pieces of the file, as listed by Metalink files or other
+// manifests. All pieces have the same length but the last one, which may be shorter.
+type PieceHashes struct {
+	Algorithm string    // As known by Verify, such as "sha1"
+	Length int64        // Size of the pieces
+	Digests []string    // Digest of each piece, in hexadecimal
+}
+
+// Error for a piece of data not matching its digest
+type PieceError struct {
+	URL string
+	Piece int
+}
+
+func (e *PieceError) Error() string {
+	return fmt.Sprintf("Source %s sent corrupt data for piece %d", e.URL, e.Piece)
+}
+
+// Check that the pieces cover a file of the given length
+func (pieces *PieceHashes) validate(fileLength int64) error {
+	if pieces.Length <= 0 {
+		return fmt.Errorf("Invalid piece length %d", pieces.Length)
+	}
+	if n := (fileLength + pieces.Length - 1) / pieces.Length; int64(len(pieces.Digests)) != n {
+		return fmt.Errorf("%d piece hashes given for a file of %d pieces", len(pieces.Digests), n)
+	}
+	_, err := newHash(pieces.Algorithm)
+	return err
+}
+
+// Offset of the beginning of the piece holding an offset
+func (pieces *PieceHashes) pieceBegin(offset int64) int64 {
+	return offset - offset % pieces.Length
+}
+
+// Hashes the pieces written by a connection, which writes its chunk in order. The piece
+// where the connection starts is skipped unless it starts at its beginning.
+type pieceHasher struct {
+	pieces *PieceHashes
+	fileLength int64
+	hash hash.Hash
+	offset int64     // Next offset to be hashed
+	skipping bool    // The beginning of the current piece wasn't seen
+}
+
+func (pieces *PieceHashes) newHasher(offset int64, fileLength int64) *pieceHasher {
+	hash, _ := newHash(pieces.Algorithm)
+	return &pieceHasher{
+		pieces: pieces,
+		fileLength: fileLength,
+		hash: hash,
+		offset: offset,
+		skipping: offset % pieces.Length != 0,
+	}
+}
+
+// Offset up to which the data hashed makes whole pieces, verified unless skipped
+func (h *pieceHasher) verified() int64 {
+	if h.offset == h.fileLength {
+		return h.offset
+	}
+	return h.pieces.pieceBegin(h.offset)
+}
+
+// Hash data following the data hashed so far. Returns the first piece found corrupt, or -1.
+func (h *pieceHasher) write(data []byte) int {
+	for len(data) > 0 {
+		piece := h.offset / h.pieces.Length
+		end := (piece + 1) * h.pieces.Length
+		if end > h.fileLength {
+			end = h.fileLength
+		}
+		n := end - h.offset
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		if !h.skipping {
+			h.hash.Write(data[:n])
+		}
+		data = data[n:]
+		h.offset += n
+		if h.offset == end {
+			sum := hex.EncodeToString(h.hash.Sum(nil))
+			verified := !h.skipping
+			h.hash.Reset()
+			h.skipping = false
+			if verified && !strings.EqualFold(sum, h.pieces.Digests[piece]) {
+				return int(piece)
+			}
+		}
+	}
+	return -1
+}
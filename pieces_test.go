@@ -0,0 +1,182 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+// Piece hashes of some data
+func sha1Pieces(data []byte, length int64) *PieceHashes {
+	pieces := &PieceHashes{Algorithm: "sha1", Length: length}
+	for begin := int64(0); begin < int64(len(data)); begin += length {
+		end := begin + length
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		sum := sha1.Sum(data[begin:end])
+		pieces.Digests = append(pieces.Digests, hex.EncodeToString(sum[:]))
+	}
+	return pieces
+}
+
+func TestPieceHasher (t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	pieces := sha1Pieces(data, 8)
+	pieces.Digests[1] = "bad"
+
+	// Corrupt pieces are reported once complete, whatever the writes
+	h := pieces.newHasher(0, int64(len(data)))
+	if piece := h.write(data[:5]); piece != -1 {
+		t.Error("An incomplete piece shouldn't be verified")
+	}
+	if piece := h.write(data[5:]); piece != 1 {
+		t.Error("Piece 1 should be corrupt, got", piece)
+	}
+
+	// Pieces started halfway can't be verified
+	h = pieces.newHasher(10, int64(len(data)))
+	if piece := h.write(data[10:]); piece != -1 {
+		t.Error("A partial piece shouldn't be verified, got", piece)
+	}
+	h = pieces.newHasher(2, int64(len(data)))
+	if piece := h.write(data[2:]); piece != 1 {
+		t.Error("Piece 1 should be corrupt, got", piece)
+	}
+
+	if err := pieces.validate(int64(len(data))); err != nil {
+		t.Error(err)
+	}
+	if err := pieces.validate(int64(len(data)) + 8); err == nil {
+		t.Error("Pieces that don't cover the file should be refused")
+	}
+}
+
+func TestPieceChunks (t *testing.T) {
+	dldr := New(nil, WithConnections(3), WithPieceHashes(&PieceHashes{Algorithm: "sha1", Length: 1000}))
+	dldr.fileLength = 1 << 20
+	dldr.buildChunks()
+	end := int64(0)
+	for _, c := range dldr.chunks {
+		if c.Begin != end || c.Begin % 1000 != 0 {
+			t.Error("Chunks should be aligned to the pieces, got", c)
+		}
+		end = c.End
+	}
+	if end != dldr.fileLength {
+		t.Error("Chunks should cover the file, up to", end)
+	}
+
+	// Splits are aligned too
+	for i := range dldr.chunks {
+		dldr.nextChunk()
+		dldr.setCurrent(i, dldr.chunks[i].Begin + 1234)
+	}
+	for n := 0; n < 10; n++ {
+		i, victim, ok := dldr.nextChunk()
+		if !ok {
+			break
+		}
+		if victim < 0 || dldr.chunks[i].Begin % 1000 != 0 {
+			t.Error("Splits should be aligned to the pieces, got", dldr.chunks[i])
+		}
+	}
+}
+
+func TestCorruptPieces (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	bad := testserver.New("test", testserver.Faults{CorruptOffset: 10000})
+	defer bad.Close()
+	good := testserver.New("test", testserver.Faults{})
+	defer good.Close()
+	pieces := sha1Pieces(reference, 1 << 14)
+
+	// The corrupt piece is fetched again from the good source
+	for _, n := range []int{1, 2} {
+		urls := []string{bad.FileURL("quijote.txt"), good.FileURL("quijote.txt")}
+		dldr := New(urls, WithConnections(n), WithPieceHashes(pieces), WithRetryPolicy(fastRetryPolicy()))
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+		_, err = dldr.SetupFile("___pieceFile___")
+		failOnError(t, err)
+		sentBefore := good.Sent()
+		failOnError(t, dldr.Download(nil))
+		compareElQuijote(t, "___pieceFile___")
+		os.Remove("___pieceFile___")
+		// The pieces from the corrupt source are kept, except the corrupt one
+		if sent := good.Sent() - sentBefore; sent >= int64(len(reference)) {
+			t.Error("Only the corrupt piece should be fetched again, got", sent, "bytes")
+		}
+	}
+
+	// Without a good source the download fails
+	dldr := New([]string{bad.FileURL("quijote.txt")}, WithConnections(2), WithPieceHashes(pieces),
+		WithRetryPolicy(fastRetryPolicy()))
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	sink := NewMemorySink()
+	dldr.sink = sink
+	var pieceErr *PieceError
+	if err := dldr.Download(nil); !errors.As(err, &pieceErr) || pieceErr.Piece != 10000 >> 14 {
+		t.Error("The corrupt piece should be reported, got", err)
+	}
+}
+
+// A source serving corrupt data isn't retried forever, even without a limit of attempts
+func TestCorruptPiecesUnlimitedRetries (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	bad := testserver.New("test", testserver.Faults{CorruptOffset: 10000})
+	defer bad.Close()
+	policy := fastRetryPolicy()
+	policy.MaxAttempts = 0
+	dldr := New([]string{bad.FileURL("quijote.txt")}, WithPieceHashes(sha1Pieces(reference, 1 << 14)),
+		WithRetryPolicy(policy))
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	dldr.sink = NewMemorySink()
+	done := make(chan error)
+	go func() {
+		done <- dldr.Download(nil)
+	}()
+	select {
+	case err := <-done:
+		var pieceErr *PieceError
+		if !errors.As(err, &pieceErr) {
+			t.Error("The corrupt piece should be reported, got", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The corrupt source should be left out")
+	}
+}
+
+// Streamed data is only written once verified, as the stream can't take corrupt data back
+func TestCorruptPiecesStream (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	bad := testserver.New("test", testserver.Faults{CorruptOffset: 10000})
+	defer bad.Close()
+	good := testserver.New("test", testserver.Faults{})
+	defer good.Close()
+	pieces := sha1Pieces(reference, 1 << 14)
+
+	for _, n := range []int{1, 2} {
+		urls := []string{bad.FileURL("quijote.txt"), good.FileURL("quijote.txt")}
+		dldr := New(urls, WithConnections(n), WithPieceHashes(pieces), WithRetryPolicy(fastRetryPolicy()))
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+		var out bytes.Buffer
+		failOnError(t, dldr.DownloadTo(&out, nil))
+		if !bytes.Equal(out.Bytes(), reference) {
+			t.Error("The streamed data should match the reference file with", n, "connections")
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package multipartdownloader
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Probing of the sources, to learn the length of the file and whether they support ranges
+//
+// A HEAD request is tried first. Many servers refuse HEAD (403 or 405, as S3 presigned URLs
+// and some CDNs do) or leave Content-Length out, and some don't tell whether they accept
+// ranges. Then the first byte is requested with GET, which answers both questions: a 206
+// response proves range support and carries the total length in its Content-Range, and a
+// 200 response means the range was ignored.
+
+// Probe a source
+func (dldr *MultiDownloader) probe(ctx context.Context, url string) urlInfo {
+	if dldr.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dldr.timeout)
+		defer cancel()
+	}
+	head := dldr.probeRequest(ctx, "HEAD", url)
+	if head.connSuccess && head.fileLength >= 0 && head.rangesKnown {
+		return head
+	}
+	get := dldr.probeRequest(ctx, "GET", url)
+	if !get.connSuccess {
+		// A usable HEAD answer is still better than nothing: ranges are tried anyway
+		if head.connSuccess && head.fileLength >= 0 {
+			head.acceptRanges = true
+			return head
+		}
+		if head.statusCode != 0 && get.statusCode == 0 {
+			return head
+		}
+		return get
+	}
+	// The GET answer only fills in what HEAD didn't tell
+	if head.connSuccess && head.fileLength >= 0 {
+		get.fileLength = head.fileLength
+	}
+	if get.etag == "" {
+		get.etag = head.etag
+	}
+	if len(get.digests) == 0 {
+		get.digests = head.digests
+	}
+	return get
+}
+
+// Internal: probe a source with a single request. GET requests only ask for the first byte.
+func (dldr *MultiDownloader) probeRequest(ctx context.Context, method string, url string) urlInfo {
+	info := urlInfo{url: url, fileLength: -1}
+	req, err := dldr.newRequest(ctx, method, url)
+	if err != nil {
+		return info
+	}
+	if method == "GET" {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := dldr.client.Do(req)
+	if err != nil {
+		return info
+	}
+	// The body of a GET ignoring the range is the whole file, which is not read
+	defer resp.Body.Close()
+
+	info.statusCode = resp.StatusCode
+	info.etag = resp.Header.Get("Etag")
+	info.disposition = resp.Header.Get("Content-Disposition")
+	info.finalURL = resp.Request.URL.String()
+	info.digests = advertisedDigests(resp.Header)
+	switch {
+	case method == "HEAD" && resp.StatusCode == http.StatusOK:
+		// Servers supporting ranges should say so, but many just don't say anything
+		acceptRanges := strings.ToLower(strings.TrimSpace(resp.Header.Get("Accept-Ranges")))
+		info.acceptRanges = acceptRanges == "bytes"
+		info.rangesKnown = acceptRanges != ""
+		info.fileLength = contentLength(resp)
+	case resp.StatusCode == http.StatusPartialContent:
+		first, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || first != 0 {
+			dldr.logVerbose("Source ", url, " answered the probe with range ", resp.Header.Get("Content-Range"))
+			return info
+		}
+		info.fileLength = total
+		info.acceptRanges = true
+		info.rangesKnown = true
+	case resp.StatusCode == http.StatusOK:
+		info.fileLength = contentLength(resp)
+		info.rangesKnown = true
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// Only an empty file has no first byte: "bytes */0"
+		if resp.Header.Get("Content-Range") != "bytes */0" {
+			return info
+		}
+		info.fileLength = 0
+		info.acceptRanges = true
+		info.rangesKnown = true
+	default:
+		return info
+	}
+	info.connSuccess = true
+	return info
+}
+
+// Digests of the file advertised by a response, in hexadecimal by algorithm. They are
+// given in base64 by Digest (RFC 3230) and X-Goog-Hash headers, as in "sha-256=X48E9q...",
+// and also enclosed in colons by Repr-Digest (RFC 9530) headers.
+func advertisedDigests(header http.Header) map[string]string {
+	digests := make(map[string]string)
+	for _, name := range []string{"Repr-Digest", "Digest", "X-Goog-Hash"} {
+		for _, value := range header.Values(name) {
+			for _, item := range strings.Split(value, ",") {
+				eq := strings.Index(item, "=")
+				if eq < 0 {
+					continue
+				}
+				algorithm := normalizeAlgorithm(strings.TrimSpace(item[:eq]))
+				encoded := strings.Trim(strings.TrimSpace(item[eq+1:]), ":")
+				digest, err := base64.StdEncoding.DecodeString(encoded)
+				if _, known := digests[algorithm]; err != nil || known {
+					continue
+				}
+				digests[algorithm] = hex.EncodeToString(digest)
+			}
+		}
+	}
+	return digests
+}
+
+// Length of the body of a response, -1 if unknown
+func contentLength(resp *http.Response) int64 {
+	length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return -1
+	}
+	return length
+}
@@ -0,0 +1,99 @@
+package multipartdownloader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+func TestProbe (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+
+	// Answering HEAD with 200 and no headers tells neither the length nor range support
+	for _, test := range []struct {
+		headStatus int
+		ranges bool
+	} {
+		{http.StatusMethodNotAllowed, true},
+		{http.StatusForbidden, false},
+		{http.StatusOK, true},
+		{http.StatusOK, false},
+	} {
+		server := testserver.New("test", testserver.Faults{HeadStatus: test.headStatus, IgnoreRange: !test.ranges})
+		dldr := New([]string{server.FileURL("quijote.txt")})
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+		if dldr.fileLength != int64(len(reference)) {
+			t.Error("HEAD status", test.headStatus, ": wrong length", dldr.fileLength)
+		}
+		if dldr.rangeless[0] == test.ranges {
+			t.Error("HEAD status", test.headStatus, ": range support should be", test.ranges)
+		}
+		if ranges := server.Ranges(); len(ranges) != 1 || ranges[0] != "bytes=0-0" {
+			t.Error("HEAD status", test.headStatus, ": the first byte should be probed, got", ranges)
+		}
+		server.Close()
+	}
+
+	// Sources refusing both requests fail with the status of the refusal
+	forbidden := testserver.New("test", testserver.Faults{ErrorStatus: http.StatusForbidden})
+	defer forbidden.Close()
+	if _, err := New([]string{forbidden.FileURL("quijote.txt")}).GatherInfo(); err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Error("A source refusing all requests should fail with its status, got", err)
+	}
+}
+
+// Sources answering the probe without ranges only get the first chunk
+func TestProbeRanges (t *testing.T) {
+	// Only one connection is used with no range support
+	rangeless := testserver.New("test", testserver.Faults{HeadStatus: http.StatusMethodNotAllowed, IgnoreRange: true})
+	defer rangeless.Close()
+	defer os.Remove("quijote.txt")
+	options := []Option{WithConnections(4), WithRetryPolicy(fastRetryPolicy())}
+	_, err := downloadElQuijote(t, []string{rangeless.FileURL("quijote.txt")}, options...)
+	failOnError(t, err)
+	if ranges := rangeless.Ranges(); len(ranges) != 2 {
+		t.Error("The file should be requested once after the probe, got", ranges)
+	}
+
+	// Sources supporting ranges download the rest of the file
+	ranged := testserver.New("test", testserver.Faults{HeadStatus: http.StatusMethodNotAllowed})
+	defer ranged.Close()
+	before := len(rangeless.Ranges())
+	_, err = downloadElQuijote(t, []string{rangeless.FileURL("quijote.txt"), ranged.FileURL("quijote.txt")}, options...)
+	failOnError(t, err)
+	for _, r := range rangeless.Ranges()[before:] {
+		if r != "bytes=0-0" && !strings.HasPrefix(r, "bytes=0-") {
+			t.Error("A source without range support was asked for", r)
+		}
+	}
+	if len(ranged.Ranges()) < 3 {
+		t.Error("The source supporting ranges should serve several chunks, got", ranged.Ranges())
+	}
+}
+
+// An empty file has no first byte to probe. The test server answers it with the whole
+// file, as http.ServeContent does, so the refusal of the range is served here.
+func TestProbeEmpty (t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes */0")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}))
+	defer server.Close()
+	dldr := New([]string{server.URL + "/empty"})
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	if dldr.fileLength != 0 || dldr.rangeless[0] {
+		t.Error("An empty file should be accepted, got length", dldr.fileLength)
+	}
+}
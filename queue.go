@@ -0,0 +1,164 @@
+package multipartdownloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Maximum number of connections, shared by several downloaders
+type ConnectionBudget struct {
+	slots chan struct{}
+}
+
+// Create a budget of maxConns connections
+func NewConnectionBudget(maxConns int) *ConnectionBudget {
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	return &ConnectionBudget{slots: make(chan struct{}, maxConns)}
+}
+
+// Take a connection, waiting for one to be free. Returns false if the context is done
+// first. A nil budget has no limit.
+func (b *ConnectionBudget) acquire(ctx context.Context) bool {
+	if b == nil {
+		return true
+	}
+	select {
+	case b.slots <- struct{}{}:
+		return true
+	case <- ctx.Done():
+		return false
+	}
+}
+
+// Give back a connection
+func (b *ConnectionBudget) release() {
+	if b != nil {
+		<- b.slots
+	}
+}
+
+// A download of a queue
+type QueueEntry struct {
+	Downloader *MultiDownloader
+	Filename string           // Output filename, as given by the sources if empty
+	Dir string                // Directory of the output file, created if missing, the current one if empty
+	Checksum *Checksum        // Expected digest, verified after downloading if not nil
+}
+
+// Outcome of a download of a queue
+type QueueResult struct {
+	URLs []string
+	Filename string           // Output filename, empty if the sources couldn't be probed
+	Size int64                // Length of the file
+	Duration time.Duration
+	Err error                 // Nil if the file was downloaded, and verified if it had a checksum
+}
+
+// Downloads of many files, sharing a connection budget
+//
+// Downloads are started in order, several at a time, and their connections are taken from
+// the budget of the queue, so the connections of all of them never exceed it. Each
+// downloader still uses no more connections than set with WithConnections.
+type Queue struct {
+	budget *ConnectionBudget
+	maxActive int
+	entries []QueueEntry
+}
+
+// Create a queue with a budget of maxConns connections, which is also the number of
+// downloads run at the same time
+func NewQueue(maxConns int) *Queue {
+	if maxConns < 1 {
+		maxConns = 1
+	}
+	return &Queue{budget: NewConnectionBudget(maxConns), maxActive: maxConns}
+}
+
+// Add a download to the queue
+func (q *Queue) Add(entry QueueEntry) {
+	entry.Downloader.connBudget = q.budget
+	q.entries = append(q.entries, entry)
+}
+
+// Run all downloads, returning their results in the order they were added. A download
+// failing doesn't stop the others, but cancelling the context stops all of them.
+func (q *Queue) Run(ctx context.Context) []QueueResult {
+	results := make([]QueueResult, len(q.entries))
+	active := make(chan struct{}, q.maxActive)
+	var wg sync.WaitGroup
+	for i := range q.entries {
+		select {
+		case active <- struct{}{}:
+		case <- ctx.Done():
+			for ; i < len(q.entries); i++ {
+				results[i] = QueueResult{URLs: q.entries[i].Downloader.candidateURLs(), Err: &CanceledError{ctx.Err()}}
+			}
+			wg.Wait()
+			return results
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = q.entries[i].Run(ctx, nil)
+			<- active
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// Download the file of an entry and verify it, outside of a queue, given a feedback
+// function as with DownloadContext. The connection budget, if any, is set by the options
+// of the downloader.
+func (entry *QueueEntry) Run(ctx context.Context, feedbackFunc func ([]ConnectionProgress)) (result QueueResult) {
+	dldr := entry.Downloader
+	start := time.Now()
+	result.URLs = dldr.candidateURLs()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	if _, result.Err = dldr.GatherInfoContext(ctx); result.Err != nil {
+		return
+	}
+	filename := entry.Filename
+	if filename == "" && entry.Dir != "" {
+		filename = dldr.filename
+	}
+	if entry.Dir != "" {
+		filename = filepath.Join(entry.Dir, filename)
+		if dldr.sink == nil {
+			if result.Err = os.MkdirAll(entry.Dir, 0755); result.Err != nil {
+				return
+			}
+		}
+	}
+	_, result.Err = dldr.SetupFile(filename)
+	if dldr.sink == nil {
+		result.Filename = dldr.filename
+	}
+	if result.Err != nil {
+		return
+	}
+	if result.Err = dldr.DownloadContext(ctx, feedbackFunc); result.Err != nil {
+		return
+	}
+	result.Size = dldr.fileLength
+	if entry.Checksum != nil {
+		result.Err = dldr.Verify(entry.Checksum.Algorithm, entry.Checksum.Digest)
+	}
+	return
+}
+
+// Internal: all sources given to the downloader
+func (dldr *MultiDownloader) candidateURLs() []string {
+	if dldr.candidates != nil {
+		return dldr.candidates
+	}
+	return dldr.urls
+}
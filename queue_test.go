@@ -0,0 +1,104 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The connections of all downloads of a queue are within its budget
+func TestQueue (t *testing.T) {
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadFile("test/" + path.Base(r.URL.Path))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == "GET" {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				active--
+				mu.Unlock()
+			}()
+			// Slow enough for the downloads to overlap
+			time.Sleep(20 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	queue := NewQueue(3)
+	wrongChecksum := &Checksum{"md5", "00000000000000000000000000000000"}
+	for i, entry := range []struct {
+		name string
+		checksum *Checksum
+	} {
+		{"quijote.txt", &Checksum{"sha256", quijoteDigests["sha256"]}},
+		{"missing.txt", nil},
+		{"quijote2.txt", wrongChecksum},
+		{"quijote.txt", nil},
+	} {
+		queue.Add(QueueEntry{
+			Downloader: New([]string{server.URL + "/" + entry.name}, WithConnections(4), WithChunkSize(1 << 14)),
+			Filename: "___queueFile" + string(rune('0' + i)),
+			Checksum: entry.checksum,
+		})
+	}
+	results := queue.Run(context.Background())
+	for _, r := range results {
+		os.Remove(r.Filename)
+	}
+
+	if len(results) != 4 {
+		t.Fatal("A result per download was expected, got", results)
+	}
+	for i, failed := range []bool{false, true, true, false} {
+		if (results[i].Err != nil) != failed {
+			t.Error("Download", i, "of", results[i].URLs, "should have failed:", failed, results[i].Err)
+		}
+	}
+	stat, err := os.Stat("test/quijote.txt")
+	failOnError(t, err)
+	if results[0].Filename != "___queueFile0" || results[0].Size != stat.Size() {
+		t.Error("Wrong result of a download:", results[0])
+	}
+	if _, ok := results[2].Err.(*ChecksumError); !ok {
+		t.Error("A wrong checksum should be reported, got", results[2].Err)
+	}
+	if maxActive > 3 {
+		t.Error("The budget is 3 connections, but", maxActive, "were open")
+	}
+	if maxActive < 2 {
+		t.Error("The downloads should run at the same time, but only", maxActive, "connections were open")
+	}
+}
+
+// Cancelling the queue stops all downloads
+func TestQueueCancel (t *testing.T) {
+	queue := NewQueue(1)
+	for i := 0; i < 3; i++ {
+		queue.Add(QueueEntry{Downloader: New([]string{"http://127.0.0.1:1/file"})})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, r := range queue.Run(ctx) {
+		if _, ok := r.Err.(*CanceledError); !ok {
+			t.Error("The downloads should be cancelled, got", r.Err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package multipartdownloader
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Selection of the sources to download from, among the ones probed by GatherInfo
+//
+// By default all sources have to be reachable and agree on the file. With WithQuorum,
+// WithExpectedSize or WithExpectedChecksum, failing sources are excluded instead, and so
+// are the ones not matching the expected size or advertising a different digest. The
+// largest group of the remaining sources agreeing on the file is kept, and the rest of them
+// are excluded too.
+
+// A source left out of the download by GatherInfo, and why
+type ExcludedSource struct {
+	URL string
+	Err error
+}
+
+// Identity of the file at a source: its length, -1 if unknown, and its ETag, "" if none
+type fileIdentity struct {
+	length int64
+	etag string
+}
+
+// Whether a source agrees on the file. Unknown lengths and missing ETags agree with any.
+func (id fileIdentity) agrees(r urlInfo) bool {
+	return (r.fileLength < 0 || r.fileLength == id.length) && (r.etag == "" || r.etag == id.etag)
+}
+
+// Get the sources excluded by the last GatherInfo
+func (dldr *MultiDownloader) ExcludedSources() []ExcludedSource {
+	return append([]ExcludedSource(nil), dldr.excluded...)
+}
+
+// Internal: whether failing and disagreeing sources are excluded rather than fatal
+func (dldr *MultiDownloader) tolerant() bool {
+	return dldr.quorum > 0 || dldr.expectedSize >= 0 || dldr.expectedChecksum != nil
+}
+
+// Internal: choose the sources to download from, given the result of probing them in the
+// order of the URLs. Returns them along with the identity of the file.
+func (dldr *MultiDownloader) selectSources(results []urlInfo) ([]urlInfo, fileIdentity, error) {
+	dldr.excluded = nil
+	if !dldr.tolerant() {
+		// Every source has to agree with the first one
+		id := fileIdentity{-1, results[0].etag}
+		for _, r := range results {
+			if !r.connSuccess {
+				return nil, id, probeError(r)
+			}
+			if id.length < 0 {
+				id.length = r.fileLength
+			}
+			if !id.agrees(r) {
+				return nil, id, errors.New("URLs must point to the same file")
+			}
+		}
+		return results, id, nil
+	}
+
+	exclude := func(r urlInfo, err error) {
+		dldr.logVerbose("Excluding source ", r.url, ": ", err)
+		dldr.excluded = append(dldr.excluded, ExcludedSource{r.url, err})
+		dldr.emit(Event{Kind: EventSourceExcluded, URL: r.url, Err: err})
+	}
+	var candidates []urlInfo
+	for _, r := range results {
+		switch {
+		case !r.connSuccess:
+			exclude(r, probeError(r))
+		case dldr.expectedSize >= 0 && r.fileLength >= 0 && r.fileLength != dldr.expectedSize:
+			exclude(r, fmt.Errorf("Length %d instead of the expected %d", r.fileLength, dldr.expectedSize))
+		case dldr.expectedChecksum != nil && r.digests[dldr.expectedChecksum.Algorithm] != "" &&
+			!strings.EqualFold(r.digests[dldr.expectedChecksum.Algorithm], dldr.expectedChecksum.Digest):
+			exclude(r, &ChecksumError{dldr.expectedChecksum.Algorithm, dldr.expectedChecksum.Digest,
+				r.digests[dldr.expectedChecksum.Algorithm]})
+		default:
+			candidates = append(candidates, r)
+		}
+	}
+
+	// The identity most sources agree on, the one of the first of them on a tie
+	var best fileIdentity
+	bestCount := 0
+	for _, c := range candidates {
+		id := fileIdentity{c.fileLength, c.etag}
+		if id.length < 0 {
+			id.length = dldr.expectedSize
+		}
+		count := 0
+		for _, r := range candidates {
+			if id.agrees(r) {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = id, count
+		}
+	}
+	var selected []urlInfo
+	for _, r := range candidates {
+		switch {
+		case best.agrees(r):
+			selected = append(selected, r)
+		case r.fileLength >= 0 && r.fileLength != best.length:
+			exclude(r, fmt.Errorf("Length %d instead of %d", r.fileLength, best.length))
+		default:
+			exclude(r, fmt.Errorf("ETag %s instead of %s", r.etag, best.etag))
+		}
+	}
+
+	quorum := dldr.quorum
+	if quorum < 1 {
+		quorum = 1
+	}
+	if len(selected) < quorum {
+		return nil, best, fmt.Errorf("Only %d of %d sources agree on the file, %d needed", len(selected), len(results), quorum)
+	}
+	return selected, best, nil
+}
+
+// Internal: the error of a failed probe
+func probeError(r urlInfo) error {
+	if r.statusCode != 0 {
+		return fmt.Errorf("Failed connection to URL %s: status %d", r.url, r.statusCode)
+	}
+	return fmt.Errorf("Failed connection to URL %s", r.url)
+}
@@ -0,0 +1,119 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+func TestAdvertisedDigests (t *testing.T) {
+	header := http.Header{}
+	header.Add("Digest", "SHA-256=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=, md5=1B2M2Y8AsgTpgAmY7PhCfg==")
+	header.Add("Repr-Digest", "sha-512=:z4PhNX7vuL3xVChQ1m2AB9Yg5AULVxXcg/SpIdNs6c5H0NE8XYXysP+DGNKHfuwvY7kxvUdBeoGlODJ6+SfaPg==:")
+	header.Add("X-Goog-Hash", "crc32c=AAAAAA==,md5=bad")
+	expected := map[string]string{
+		"sha256": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"md5": "d41d8cd98f00b204e9800998ecf8427e",
+		"sha512": "cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e",
+		"crc32c": "00000000",
+	}
+	if digests := advertisedDigests(header); !reflect.DeepEqual(digests, expected) {
+		t.Error("Wrong digests parsed:", digests)
+	}
+}
+
+// Sources failing or disagreeing with the majority are left out
+func TestQuorum (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	wrongLength := testserver.New("test", testserver.Faults{ContentLengthDelta: 1})
+	defer wrongLength.Close()
+	otherETag := testserver.New("test", testserver.Faults{ETag: "other"})
+	defer otherETag.Close()
+	etag := testserver.New("test", testserver.Faults{ETag: "v1"})
+	defer etag.Close()
+
+	urls := []string{
+		server.FileURL("missing.txt"),
+		wrongLength.FileURL("quijote.txt"),
+		etag.FileURL("quijote.txt"),
+		server.FileURL("quijote.txt"),
+		otherETag.FileURL("quijote.txt"),
+		etag.FileURL("quijote2.txt"),
+	}
+	dldr := New(urls, WithConnections(4), WithQuorum(3))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	selected := []string{etag.FileURL("quijote.txt"), server.FileURL("quijote.txt"), etag.FileURL("quijote2.txt")}
+	if !reflect.DeepEqual(dldr.urls, selected) || dldr.ETag != "v1" {
+		t.Error("The sources agreeing on the file should be selected, got", dldr.urls, dldr.ETag)
+	}
+	excluded := dldr.ExcludedSources()
+	if len(excluded) != 3 {
+		t.Fatal("3 sources should be excluded, got", excluded)
+	}
+	for i, reason := range []string{"status 404", "Length", "ETag"} {
+		if excluded[i].URL != urls[[]int{0, 1, 4}[i]] || !strings.Contains(excluded[i].Err.Error(), reason) {
+			t.Error("Wrong exclusion:", excluded[i].URL, excluded[i].Err)
+		}
+	}
+
+	_, err = dldr.SetupFile("___quorumFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+	failOnError(t, dldr.Download(nil))
+	compareElQuijote(t, dldr.filename)
+
+	// Not enough sources agree
+	if _, err := New(urls, WithQuorum(4)).GatherInfo(); err == nil {
+		t.Error("4 sources should not be found to agree")
+	}
+}
+
+// The expected size or digest decides which sources are right
+func TestExpectedFile (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	advertising := func(digest string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Digest", "sha-256=" + digest)
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(reference))
+		}))
+	}
+	good := advertising("HpuxsW+IEORNbV7ecAUlhRj6l2cZvC7SVDCOc8NXz8w=")
+	defer good.Close()
+	bad := advertising("47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=")
+	defer bad.Close()
+	wrongLength := testserver.New("test", testserver.Faults{ContentLengthDelta: 1})
+	defer wrongLength.Close()
+	wrongLength2 := testserver.New("test", testserver.Faults{ContentLengthDelta: 1})
+	defer wrongLength2.Close()
+
+	urls := []string{wrongLength.FileURL("quijote.txt"), wrongLength2.FileURL("quijote.txt"), good.URL + "/quijote.txt"}
+	dldr := New(urls, WithExpectedSize(int64(len(reference))))
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	if !reflect.DeepEqual(dldr.urls, urls[2:]) || len(dldr.ExcludedSources()) != 2 {
+		t.Error("Only the source of the expected size should be selected, got", dldr.urls)
+	}
+
+	urls = []string{bad.URL + "/quijote.txt", good.URL + "/quijote.txt"}
+	dldr = New(urls, WithExpectedChecksum(Checksum{"SHA-256", quijoteDigests["sha256"]}))
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	excluded := dldr.ExcludedSources()
+	if !reflect.DeepEqual(dldr.urls, urls[1:]) || len(excluded) != 1 {
+		t.Fatal("Only the source advertising the expected digest should be selected, got", dldr.urls)
+	}
+	if _, ok := excluded[0].Err.(*ChecksumError); !ok {
+		t.Error("The source should be excluded for its digest, got", excluded[0].Err)
+	}
+}
@@ -0,0 +1,81 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+// Write a file of random data of the given size
+func writeRandomFile(filename string, size int) ([]byte, error) {
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	return content, ioutil.WriteFile(filename, content, 0644)
+}
+
+// Bytes requested by range requests, and whether some range went past the end of the file
+func requestedBytes(ranges []string, size int) (requested int64, beyondEnd bool) {
+	for _, r := range ranges {
+		var first, last int64
+		if _, err := fmt.Sscanf(r, "bytes=%d-%d", &first, &last); err == nil {
+			requested += last - first + 1
+			beyondEnd = beyondEnd || last >= int64(size)
+		}
+	}
+	return requested, beyondEnd
+}
+
+// Every byte is requested exactly once, whatever the number of connections and chunks. When
+// chunks are split while downloading, part of their range is left unread instead.
+func TestRangeBoundaries (t *testing.T) {
+	dir, err := ioutil.TempDir("", "range-test")
+	failOnError(t, err)
+	defer os.RemoveAll(dir)
+
+	sources := filepath.Join(dir, "sources")
+	failOnError(t, os.Mkdir(sources, 0755))
+	server := testserver.New(sources, testserver.Faults{})
+	defer server.Close()
+
+	sizes := []int{0, 1, 2, 3, 7, 63, 65, 4097, 65537, 131071}
+	chunkSizes := []int64{0, 1000}
+	for _, size := range sizes {
+		source := fmt.Sprintf("file-%d", size)
+		content, err := writeRandomFile(filepath.Join(sources, source), size)
+		failOnError(t, err)
+		for _, chunkSize := range chunkSizes {
+			for n := 1; n <= 64; n++ {
+				before := len(server.Ranges())
+				filename := filepath.Join(dir, fmt.Sprintf("file-%d-%d-%d", size, chunkSize, n))
+				dldr := New([]string{server.FileURL(source)}, WithConnections(n), WithChunkSize(chunkSize))
+				_, err := dldr.GatherInfo()
+				failOnError(t, err)
+				_, err = dldr.SetupFile(filename)
+				failOnError(t, err)
+				nChunks := len(dldr.Chunks())
+				if err := dldr.Download(nil); err != nil {
+					t.Fatal("Download of", size, "bytes with", n, "connections failed:", err)
+				}
+				result, err := ioutil.ReadFile(filename)
+				failOnError(t, err)
+				if !bytes.Equal(content, result) {
+					t.Fatal("Download of", size, "bytes with", n, "connections and chunk size", chunkSize, "is corrupt")
+				}
+				requested, beyondEnd := requestedBytes(server.Ranges()[before:], size)
+				if beyondEnd {
+					t.Fatal("Download of", size, "bytes with", n, "connections requested bytes past the end")
+				}
+				if len(dldr.Chunks()) == nChunks && requested != int64(size) {
+					t.Fatal("Download of", size, "bytes with", n, "connections requested", requested, "bytes")
+				}
+				os.Remove(filename)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package multipartdownloader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Token bucket limiting bandwidth, safe for concurrent use. It can be shared by several
+// downloaders, and its rate changed at any time.
+type RateLimiter struct {
+	mu sync.Mutex
+	rate int64       // Bytes per second, unlimited if 0
+	tokens float64   // Bytes that can be transferred right now, negative when in debt
+	last time.Time   // Last time tokens were added
+	changed chan struct{}  // Closed when the rate changes, to wake up waiting transfers
+}
+
+// Create a limiter for the given bytes per second, unlimited if 0
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{rate: bytesPerSecond, last: time.Now(), changed: make(chan struct{})}
+}
+
+// Change the bytes per second, unlimited if 0
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if bytesPerSecond <= 0 {
+		l.tokens = 0
+	}
+	l.rate = bytesPerSecond
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Get the bytes per second, unlimited if 0
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Add the tokens earned since the last time, up to one second worth of them
+func (l *RateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// Account for n transferred bytes, waiting as long as needed to respect the rate. The
+// wait is shortened or extended if the rate changes meanwhile.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	rate := l.rate
+	changed := l.changed
+	wait := time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	l.mu.Unlock()
+
+	for wait > 0 {
+		deadline := time.Now().Add(wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <- timer.C:
+			return nil
+		case <- ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <- changed:
+			timer.Stop()
+		}
+		// The bytes owed are now paid at the new rate
+		l.mu.Lock()
+		if l.rate <= 0 {
+			l.mu.Unlock()
+			return nil
+		}
+		wait = time.Duration(float64(time.Until(deadline)) * float64(rate) / float64(l.rate))
+		rate = l.rate
+		changed = l.changed
+		l.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package multipartdownloader
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+func TestRateLimiter (t *testing.T) {
+	ctx := context.Background()
+	limiter := NewRateLimiter(100 << 10)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		failOnError(t, limiter.WaitN(ctx, 10 << 10))
+	}
+	if elapsed := time.Since(start); elapsed < 400 * time.Millisecond {
+		t.Error("50KiB at 100KiB/s should take about 500ms, took", elapsed)
+	}
+
+	// Unlimited once the rate is removed
+	limiter.SetRate(0)
+	start = time.Now()
+	failOnError(t, limiter.WaitN(ctx, 1 << 30))
+	if elapsed := time.Since(start); elapsed > 100 * time.Millisecond {
+		t.Error("An unlimited limiter shouldn't wait, took", elapsed)
+	}
+
+	// Waiting stops with the context
+	limiter.SetRate(1)
+	ctx, cancel := context.WithTimeout(ctx, 50 * time.Millisecond)
+	defer cancel()
+	if err := limiter.WaitN(ctx, 1 << 20); err == nil {
+		t.Error("Waiting should be interrupted by the context")
+	}
+}
+
+// Download the reference file, returning the downloader and how long it took
+func timedDownload(t *testing.T, urls []string, options ...Option) (*MultiDownloader, time.Duration) {
+	start := time.Now()
+	dldr, err := downloadElQuijote(t, urls, options...)
+	elapsed := time.Since(start)
+	failOnError(t, err)
+	os.Remove(dldr.filename)
+	return dldr, elapsed
+}
+
+func TestRateLimit (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	urls := []string{server.FileURL("quijote.txt"), server.FileURL("quijote.txt")}
+
+	// About 310KiB at 1MiB/s in total, whatever the number of connections
+	if _, elapsed := timedDownload(t, urls, WithConnections(4), WithRateLimit(1 << 20)); elapsed < 250 * time.Millisecond {
+		t.Error("Download should be limited to 1MiB/s, took", elapsed)
+	}
+
+	// Each source limited to 512KiB/s
+	if _, elapsed := timedDownload(t, urls, WithConnections(4), WithSourceRateLimit(512 << 10)); elapsed < 250 * time.Millisecond {
+		t.Error("Download should be limited to 512KiB/s per source, took", elapsed)
+	}
+
+	// Lifting the limits during the download, scheduled as the last option
+	lift := func(dldr *MultiDownloader) {
+		time.AfterFunc(100 * time.Millisecond, func() {
+			dldr.SetRateLimit(0)
+			dldr.SetSourceRateLimit(0)
+		})
+	}
+	if _, elapsed := timedDownload(t, urls, WithConnections(2), WithRateLimit(1 << 10), WithSourceRateLimit(1 << 10),
+		lift); elapsed > 5 * time.Second {
+		t.Error("The limits should be lifted during the download, took", elapsed)
+	}
+}
+
+// A limit can be set while downloading without any given at first, run with -race
+func TestSetRateLimitWhileDownloading (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{BytesPerSecond: 256 << 10})
+	defer server.Close()
+	changes := func(dldr *MultiDownloader) {
+		time.AfterFunc(50 * time.Millisecond, func() {
+			dldr.SetRateLimit(64 << 10)
+			time.Sleep(100 * time.Millisecond)
+			dldr.SetRateLimit(0)
+		})
+	}
+	dldr, elapsed := timedDownload(t, []string{server.FileURL("quijote.txt")}, WithConnections(4), changes)
+	if elapsed > 5 * time.Second {
+		t.Error("The limit should be lifted during the download, took", elapsed)
+	}
+	if rate := dldr.rateLimiter.Rate(); rate != 0 {
+		t.Error("The limit should be lifted, got", rate)
+	}
+}
@@ -0,0 +1,194 @@
+package multipartdownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Policy deciding whether and when failed range requests are retried
+//
+// Every failure of a chunk counts as an attempt, and each retry goes to the next source.
+// Attempts are counted again from zero whenever a request delivers some data, since the
+// chunk then resumes from its last written byte. A corrupt piece sends the chunk to another
+// source without counting an attempt; when no other source is left, it counts as any other
+// failure, and a source serving a few corrupt pieces for a chunk is left out for it.
+type RetryPolicy struct {
+	MaxAttempts int               // Consecutive failures of a chunk before its connection gives up, 0 to retry forever
+	InitialBackoff time.Duration  // Wait after the first failure
+	MaxBackoff time.Duration      // Maximum wait, unless a server asks for more with Retry-After
+	Multiplier float64            // Growth of the wait after each failure
+	Jitter float64                // Random variation of the wait, as a fraction of it (0.2 is ±20%)
+	RetryableStatuses []int       // HTTP statuses worth retrying
+	RetryableError func(error) bool  // Network errors worth retrying, IsRetryableError if nil
+}
+
+// The retry policy used unless WithRetryPolicy is given
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		Multiplier: 2,
+		Jitter: 0.2,
+		RetryableStatuses: []int{
+			http.StatusRequestTimeout,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// Error for an unexpected HTTP status of a source
+type StatusError struct {
+	URL string
+	StatusCode int
+	RetryAfter time.Duration  // Wait requested by the server with Retry-After, if any
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Source %s responded with status %d", e.URL, e.StatusCode)
+}
+
+// Build the error for an unexpected response, reading its Retry-After header
+func newStatusError(url string, resp *http.Response) *StatusError {
+	return &StatusError{
+		URL: url,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// Tell whether a network error is likely temporary: timeouts, refused or reset
+// connections and transfers cut short
+func IsRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// Whether a failure is worth retrying, and how long the server asked to wait
+func (policy *RetryPolicy) classify(err error) (retryable bool, retryAfter time.Duration) {
+	// Corrupt data may come from a glitch, or from a source serving another file, which
+	// is left out after a few pieces
+	var pieceErr *PieceError
+	if errors.As(err, &pieceErr) {
+		return true, 0
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		for _, status := range policy.RetryableStatuses {
+			if status == statusErr.StatusCode {
+				return true, statusErr.RetryAfter
+			}
+		}
+		return false, 0
+	}
+	if policy.RetryableError != nil {
+		return policy.RetryableError(err), 0
+	}
+	return IsRetryableError(err), 0
+}
+
+// What follows a failed request
+type retryDecision int
+
+const (
+	retryNext retryDecision = iota  // Retry, with the next source
+	retrySkip                       // Leave out the source, which can't serve the request
+	retryStop                       // Give up, as the attempts are exhausted or the context is done
+)
+
+// Consecutive failures of a transfer, counted as told by a retry policy
+type attempts struct {
+	policy *RetryPolicy
+	count int
+}
+
+// Count a failed request, telling whether it wrote some data, and decide what follows.
+// Waits for the backoff before a retry.
+func (a *attempts) failed(ctx context.Context, err error, progress bool) retryDecision {
+	// The transfer resumes from the last written byte, so progress resets the attempts
+	if progress {
+		a.count = 0
+	}
+	a.count++
+	if a.policy.MaxAttempts > 0 && a.count >= a.policy.MaxAttempts {
+		return retryStop
+	}
+	retryable, retryAfter := a.policy.classify(err)
+	if !retryable {
+		return retrySkip
+	}
+	if !sleepContext(ctx, a.policy.backoff(a.count, retryAfter)) {
+		return retryStop
+	}
+	return retryNext
+}
+
+// Wait before the given attempt (1 after the first failure), honouring Retry-After
+func (policy *RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	wait := float64(policy.InitialBackoff) * math.Pow(policy.Multiplier, float64(attempt - 1))
+	if policy.MaxBackoff > 0 && wait > float64(policy.MaxBackoff) {
+		wait = float64(policy.MaxBackoff)
+	}
+	if policy.Jitter > 0 {
+		wait *= 1 - policy.Jitter + 2 * policy.Jitter * rand.Float64()
+	}
+	if time.Duration(wait) < retryAfter {
+		return retryAfter
+	}
+	return time.Duration(wait)
+}
+
+// Parse a Retry-After header, either in seconds or as an HTTP date
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// Sleep, unless the context is done first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <- timer.C:
+		return true
+	case <- ctx.Done():
+		return false
+	}
+}
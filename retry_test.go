@@ -0,0 +1,162 @@
+package multipartdownloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+func TestParseRetryAfter (t *testing.T) {
+	now := time.Date(2015, 5, 1, 12, 0, 0, 0, time.UTC)
+	testTable := []struct {
+		header string
+		wait time.Duration
+	} {
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"soon", 0},
+		{"Fri, 01 May 2015 12:00:30 GMT", 30 * time.Second},
+		{"Fri, 01 May 2015 11:00:00 GMT", 0},
+	}
+	for _, test := range testTable {
+		if wait := parseRetryAfter(test.header, now); wait != test.wait {
+			t.Error("Retry-After", test.header, "should be", test.wait, "got", wait)
+		}
+	}
+}
+
+func TestBackoff (t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff: time.Second,
+		Multiplier: 2,
+	}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, wait := range expected {
+		if b := policy.backoff(i + 1, 0); b != wait * time.Millisecond {
+			t.Error("Attempt", i + 1, "should wait", wait, "ms, got", b)
+		}
+	}
+	if b := policy.backoff(1, 5 * time.Second); b != 5 * time.Second {
+		t.Error("Retry-After should be honoured, got", b)
+	}
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if b := policy.backoff(1, 0); b < 50 * time.Millisecond || b > 150 * time.Millisecond {
+			t.Fatal("Jitter out of bounds:", b)
+		}
+	}
+}
+
+func fastRetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy()
+	policy.InitialBackoff = time.Millisecond
+	policy.MaxBackoff = 10 * time.Millisecond
+	return policy
+}
+
+// Temporary errors are retried, as told by Retry-After
+func TestRetryUnavailable (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+
+	dldr := New([]string{server.FileURL("quijote.txt")}, WithRetryPolicy(fastRetryPolicy()))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___retryFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+
+	server.SetFaults(testserver.Faults{ErrorStatus: http.StatusServiceUnavailable, ErrorCount: 1, RetryAfter: "1"})
+	start := time.Now()
+	err = dldr.Download(nil)
+	if err != nil {
+		t.Fatal("Download should succeed after retrying:", err)
+	}
+	if time.Since(start) < time.Second {
+		t.Error("Retry-After should be honoured")
+	}
+}
+
+// Permanent errors are not retried
+func TestRetryNotFound (t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	fileServer := http.FileServer(http.Dir("test"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			fileServer.ServeHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	_, err := downloadElQuijote(t, []string{server.URL + "/quijote.txt"}, WithRetryPolicy(fastRetryPolicy()))
+	if err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Fatal("Download should fail with the status of the source, got", err)
+	}
+	if requests != 1 {
+		t.Error("A missing file should not be requested again, got", requests, "requests")
+	}
+}
+
+// A transfer cut short resumes from the last written byte
+func TestRetryResume (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{DropAfter: 100000, DropCount: 1})
+	defer server.Close()
+
+	dldr := New([]string{server.FileURL("quijote.txt")},
+		WithChunkSize(1 << 30),
+		WithRetryPolicy(fastRetryPolicy()))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___retryFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+	err = dldr.Download(nil)
+	failOnError(t, err)
+
+	compareElQuijote(t, dldr.filename)
+	ranges := server.Ranges()
+	if len(ranges) != 2 || strings.HasPrefix(ranges[1], "bytes=0-") {
+		t.Error("The interrupted chunk should be resumed from its last byte, got requests", ranges)
+	}
+}
+
+func TestAttempts (t *testing.T) {
+	policy := fastRetryPolicy()
+	policy.MaxAttempts = 3
+	failures := attempts{policy: &policy}
+	ctx := context.Background()
+	unavailable := &StatusError{StatusCode: http.StatusServiceUnavailable}
+	if d := failures.failed(ctx, unavailable, false); d != retryNext {
+		t.Error("A retryable failure should be retried, got", d)
+	}
+	if d := failures.failed(ctx, &StatusError{StatusCode: http.StatusNotFound}, false); d != retrySkip {
+		t.Error("The source should be left out after a non retryable failure, got", d)
+	}
+	if d := failures.failed(ctx, unavailable, false); d != retryStop {
+		t.Error("The attempts should be exhausted, got", d)
+	}
+	// Progress resets the attempts
+	if d := failures.failed(ctx, unavailable, true); d != retryNext {
+		t.Error("A failure after some progress should be retried, got", d)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if d := failures.failed(ctx, unavailable, false); d != retryStop {
+		t.Error("Retries should stop with the context, got", d)
+	}
+}
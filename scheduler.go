@@ -0,0 +1,248 @@
+package multipartdownloader
+
+// Scheduling of the chunks among connections
+//
+// The file is split into more chunks than connections. Each connection takes the first
+// pending chunk from the table and, once there is none left, steals the second half of the
+// largest chunk still being downloaded. This way a fast source ends up finishing the work
+// started by a slow one, instead of the slowest source deciding the total download time.
+//
+// Chunks may only shrink at their end, and never below the bytes already written or about
+// to be written by their connection, so the ranges written concurrently never overlap.
+
+const (
+	chunksPerConn = 4         // Chunks per connection when no chunk size is set
+	minChunkSize = 1 << 16    // Minimum size of the chunks when no chunk size is set
+	minStealSize = 1 << 14    // Chunks with less than this remaining are not split
+)
+
+// Internal: decide how many chunks the file is divided into
+func (dldr *MultiDownloader) numChunks() int64 {
+	if dldr.chunkSize > 0 {
+		n := (dldr.fileLength + dldr.chunkSize - 1) / dldr.chunkSize
+		if n == 0 {
+			n = 1
+		}
+		return n
+	}
+	n := int64(dldr.nConns) * chunksPerConn
+	if max := dldr.fileLength / minChunkSize; max < n {
+		n = max
+	}
+	if n < int64(dldr.nConns) {
+		n = int64(dldr.nConns)
+	}
+	return n
+}
+
+// Internal: build a chunks table aligned to the pieces, so every piece is downloaded
+// by a single connection and can be verified as it arrives
+func (dldr *MultiDownloader) buildPieceChunks(n int64) {
+	pieceLength := dldr.pieceHashes.Length
+	chunkSize := (dldr.fileLength + n - 1) / n
+	chunkSize = (chunkSize + pieceLength - 1) / pieceLength * pieceLength
+	dldr.chunks = nil
+	for begin := int64(0); begin < dldr.fileLength || len(dldr.chunks) == 0; begin += chunkSize {
+		end := begin + chunkSize
+		if end > dldr.fileLength {
+			end = dldr.fileLength
+		}
+		dldr.chunks = append(dldr.chunks, Chunk{begin, end})
+	}
+	dldr.current = make([]int64, len(dldr.chunks))
+	dldr.active = make([]bool, len(dldr.chunks))
+	dldr.nextPending = 0
+	for i, c := range dldr.chunks {
+		dldr.current[i] = c.Begin
+	}
+}
+
+// Internal: where the remaining part of a chunk would be split, aligned to the pieces
+// if there are piece hashes. Returns false if it can't be split.
+func (dldr *MultiDownloader) splitPoint(i int) (int64, bool) {
+	end := dldr.chunks[i].End
+	middle := dldr.current[i] + (end - dldr.current[i]) / 2
+	if dldr.pieceHashes != nil {
+		pieceLength := dldr.pieceHashes.Length
+		middle = (middle + pieceLength - 1) / pieceLength * pieceLength
+	}
+	return middle, middle < end
+}
+
+// Take the first pending chunk, or split the largest one in progress if there is none, in
+// which case the victim chunk is returned too (-1 otherwise). Returns false when there is
+// nothing left to do.
+//
+// While streaming, pending chunks beginning too far from the stream position have to wait
+// for it to advance, so the memory used for reordering the data stays bounded.
+func (dldr *MultiDownloader) nextChunk() (i int, victim int, ok bool) {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	for {
+		i, victim, ok, wait := dldr.takeChunk()
+		if !wait || dldr.streamStopped {
+			return i, victim, ok
+		}
+		dldr.streamCond.Wait()
+	}
+}
+
+// Internal: nextChunk without waiting. Tells whether there are pending chunks out of the
+// stream window when there is nothing else to do.
+func (dldr *MultiDownloader) takeChunk() (i int, victim int, ok bool, wait bool) {
+	firstPending := len(dldr.chunks)
+	for i = dldr.nextPending; i < len(dldr.chunks); i++ {
+		if !dldr.active[i] && dldr.current[i] < dldr.chunks[i].End {
+			if dldr.streamWindow > 0 && dldr.chunks[i].Begin >= dldr.streamEnd {
+				if i < firstPending {
+					firstPending = i
+				}
+				continue
+			}
+			dldr.active[i] = true
+			dldr.nextPending = i + 1
+			if firstPending < i {
+				dldr.nextPending = firstPending
+			}
+			return i, -1, true, false
+		}
+	}
+	dldr.nextPending = firstPending
+
+	// Split chunks can't be requested from sources without range support
+	if dldr.noRangeSupport() {
+		return 0, -1, false, false
+	}
+
+	// Steal from the chunk with most bytes remaining
+	minRemaining := int64(minStealSize)
+	if min := 2 * int64(dldr.bufferSize); min > minRemaining {
+		minRemaining = min
+	}
+	victim = -1
+	var middle int64
+	for j, c := range dldr.chunks {
+		remaining := c.End - dldr.current[j]
+		if dldr.active[j] && remaining >= minRemaining {
+			if split, ok := dldr.splitPoint(j); ok {
+				minRemaining = remaining
+				victim = j
+				middle = split
+			}
+		}
+	}
+	if victim < 0 {
+		return 0, -1, false, firstPending < len(dldr.chunks)
+	}
+	// The victim keeps at least a buffer, the largest write it can have in flight
+	end := dldr.chunks[victim].End
+	dldr.chunks[victim].End = middle
+	dldr.chunks = append(dldr.chunks, Chunk{middle, end})
+	dldr.current = append(dldr.current, middle)
+	dldr.active = append(dldr.active, true)
+	return len(dldr.chunks) - 1, victim, true, false
+}
+
+// Give a chunk back, so another connection can take it if it is incomplete
+func (dldr *MultiDownloader) releaseChunk(i int) {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	dldr.active[i] = false
+	if dldr.current[i] < dldr.chunks[i].End && i < dldr.nextPending {
+		dldr.nextPending = i
+	}
+	if dldr.streamCond != nil {
+		dldr.streamCond.Broadcast()
+	}
+}
+
+// How many of n bytes, to be written at the current position, still belong to a chunk
+func (dldr *MultiDownloader) writable(i int, n int) int {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	if remaining := dldr.chunks[i].End - dldr.current[i]; remaining < int64(n) {
+		return int(remaining)
+	}
+	return n
+}
+
+// Whether a chunk spans the whole file
+func (dldr *MultiDownloader) wholeFileChunk(i int) bool {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	return len(dldr.chunks) == 1 && dldr.chunks[i].Begin == 0
+}
+
+// Replace the chunks table with a single chunk for the whole file, unless it is complete.
+// Returns false if there is nothing left to download.
+func (dldr *MultiDownloader) singleChunk() bool {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	for i, c := range dldr.chunks {
+		if dldr.current[i] < c.End {
+			dldr.chunks = []Chunk{{0, dldr.fileLength}}
+			dldr.current = []int64{0}
+			dldr.active = []bool{false}
+			dldr.nextPending = 0
+			return true
+		}
+	}
+	return false
+}
+
+// Whether all chunks are downloaded
+func (dldr *MultiDownloader) complete() bool {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	for i, c := range dldr.chunks {
+		if dldr.current[i] < c.End {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the progress of a chunk, along with its current boundaries
+func (dldr *MultiDownloader) chunkProgress(i int) ConnectionProgress {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	return ConnectionProgress{
+		Id: i,
+		Begin: dldr.chunks[i].Begin,
+		End: dldr.chunks[i].End,
+		Current: dldr.current[i],
+	}
+}
+
+// Get the progress of all chunks
+func (dldr *MultiDownloader) progressSnapshot() []ConnectionProgress {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	progressArray := make([]ConnectionProgress, len(dldr.chunks))
+	for i, c := range dldr.chunks {
+		progressArray[i] = ConnectionProgress{
+			Id: i,
+			Begin: c.Begin,
+			End: c.End,
+			Current: dldr.current[i],
+		}
+	}
+	return progressArray
+}
+
+// Record the progress of a chunk
+func (dldr *MultiDownloader) setCurrent(i int, cursor int64) {
+	dldr.progressMu.Lock()
+	if cursor > dldr.chunks[i].End {
+		cursor = dldr.chunks[i].End
+	}
+	dldr.current[i] = cursor
+	dldr.progressMu.Unlock()
+}
+
+// Get the progress of a chunk
+func (dldr *MultiDownloader) getCurrent(i int) int64 {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	return dldr.current[i]
+}
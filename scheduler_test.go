@@ -0,0 +1,66 @@
+package multipartdownloader
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+func TestNumChunks (t *testing.T) {
+	testTable := []struct {
+		fileLength int64
+		nConns int
+		chunkSize int64
+		n int64
+	} {
+		{125, 3, 0, 3},
+		{10 * minChunkSize, 2, 0, 2 * chunksPerConn},
+		{3 * minChunkSize, 2, 0, 3},
+		{1000, 2, 100, 10},
+		{1001, 2, 100, 11},
+		{0, 2, 100, 1},
+	}
+	for _, test := range testTable {
+		dldr := New(nil, WithConnections(test.nConns), WithChunkSize(test.chunkSize))
+		dldr.fileLength = test.fileLength
+		if n := dldr.numChunks(); n != test.n {
+			t.Error("Expected", test.n, "chunks for", test.fileLength, "bytes, got", n)
+		}
+	}
+}
+
+// A fast source takes over the chunks of a slow one
+func TestWorkStealing (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	fast := testserver.New("test", testserver.Faults{})
+	defer fast.Close()
+	slow := testserver.New("test", testserver.Faults{BytesPerSecond: 1 << 19})
+	defer slow.Close()
+
+	dldr := New([]string{fast.FileURL("quijote.txt"), slow.FileURL("quijote.txt")},
+		WithConnections(2),
+		WithChunkSize(int64(len(reference) / 2 + 1)))
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___stealFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+
+	maxId := 0
+	err = dldr.Download(func(progress []ConnectionProgress) {
+		for _, p := range progress {
+			if p.Id > maxId {
+				maxId = p.Id
+			}
+		}
+	})
+	failOnError(t, err)
+
+	if n := len(dldr.Chunks()); n <= 2 || maxId != n - 1 {
+		t.Error("Chunks of the slow source should have been split, got", n, "chunks and", maxId + 1, "reported")
+	}
+	compareElQuijote(t, dldr.filename)
+}
@@ -0,0 +1,187 @@
+package multipartdownloader
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Storage receiving the downloaded data
+//
+// Connections call WriteAt concurrently, on ranges that never overlap. Truncate is called
+// with the file length before the download starts, Sync before the progress is saved,
+// and then either Commit when the file is complete or Abort when the download stops
+// without completing it.
+type Sink interface {
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Commit() error
+	Abort() error
+}
+
+// Sink writing to a local file through a temporary file, renamed on Commit. The temporary
+// file is kept on Abort.
+type FileSink struct {
+	filename string
+	partFilename string
+	file *os.File
+}
+
+// Create a sink for filename, written as partFilename until complete
+func NewFileSink(filename string, partFilename string) *FileSink {
+	return &FileSink{filename: filename, partFilename: partFilename}
+}
+
+// Internal: open the temporary file, creating it if needed
+func (s *FileSink) open(flag int) error {
+	if s.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(s.partFilename, os.O_WRONLY | flag, 0666)
+	if err != nil {
+		return err
+	}
+	s.file = file
+	return nil
+}
+
+func (s *FileSink) WriteAt(p []byte, off int64) (int, error) {
+	return s.file.WriteAt(p, off)
+}
+
+func (s *FileSink) Truncate(size int64) error {
+	if err := s.open(os.O_CREATE); err != nil {
+		return err
+	}
+	return s.file.Truncate(size)
+}
+
+func (s *FileSink) Sync() error {
+	return s.file.Sync()
+}
+
+func (s *FileSink) Commit() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	return os.Rename(s.partFilename, s.filename)
+}
+
+func (s *FileSink) Abort() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Sink keeping the file in memory
+type MemorySink struct {
+	mu sync.Mutex
+	data []byte
+	committed bool
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (s *MemorySink) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(s.data)) {
+		s.data = append(s.data, make([]byte, end - int64(len(s.data)))...)
+	}
+	return copy(s.data[off:], p), nil
+}
+
+func (s *MemorySink) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *MemorySink) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size <= int64(len(s.data)) {
+		s.data = s.data[:size]
+	} else {
+		s.data = append(s.data, make([]byte, size - int64(len(s.data)))...)
+	}
+	return nil
+}
+
+func (s *MemorySink) Sync() error {
+	return nil
+}
+
+func (s *MemorySink) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.committed = true
+	return nil
+}
+
+// Discard the data
+func (s *MemorySink) Abort() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = nil
+	return nil
+}
+
+// Get the downloaded file, nil until it is complete
+func (s *MemorySink) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.committed {
+		return nil
+	}
+	return s.data
+}
+
+// Sink writing to a file opened by the caller, who is in charge of closing it
+type OpenFileSink struct {
+	file *os.File
+}
+
+// Create a sink for an open file, or a file descriptor through os.NewFile
+func NewOpenFileSink(file *os.File) *OpenFileSink {
+	return &OpenFileSink{file: file}
+}
+
+func (s *OpenFileSink) WriteAt(p []byte, off int64) (int, error) {
+	return s.file.WriteAt(p, off)
+}
+
+func (s *OpenFileSink) ReadAt(p []byte, off int64) (int, error) {
+	return s.file.ReadAt(p, off)
+}
+
+func (s *OpenFileSink) Truncate(size int64) error {
+	return s.file.Truncate(size)
+}
+
+func (s *OpenFileSink) Sync() error {
+	return s.file.Sync()
+}
+
+func (s *OpenFileSink) Commit() error {
+	return s.file.Sync()
+}
+
+// Leave the file as it is
+func (s *OpenFileSink) Abort() error {
+	return nil
+}
@@ -0,0 +1,95 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+// Sink recording the calls made to it
+type recordingSink struct {
+	MemorySink
+	calls []string
+}
+
+func (s *recordingSink) Truncate(size int64) error {
+	s.calls = append(s.calls, "Truncate")
+	return s.MemorySink.Truncate(size)
+}
+
+func (s *recordingSink) Commit() error {
+	s.calls = append(s.calls, "Commit")
+	return s.MemorySink.Commit()
+}
+
+func (s *recordingSink) Abort() error {
+	s.calls = append(s.calls, "Abort")
+	return s.MemorySink.Abort()
+}
+
+func TestMemorySink (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+
+	sink := &recordingSink{}
+	_, err = downloadElQuijote(t, []string{server.FileURL("quijote.txt")}, WithConnections(4), WithSink(sink),
+		WithRetryPolicy(fastRetryPolicy()))
+	failOnError(t, err)
+	if !bytes.Equal(reference, sink.Bytes()) {
+		t.Error("Data in memory does not match the reference file")
+	}
+	if len(sink.calls) != 2 || sink.calls[0] != "Truncate" || sink.calls[1] != "Commit" {
+		t.Error("The sink should be truncated and committed, got", sink.calls)
+	}
+	if _, err := os.Stat("quijote.txt" + tmpFileSuffix); !os.IsNotExist(err) {
+		t.Error("Nothing should be written to disk")
+	}
+
+	// A failed download is aborted
+	sink = &recordingSink{}
+	dldr := New([]string{server.FileURL("quijote.txt")}, WithSink(sink))
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	server.SetFaults(testserver.Faults{ErrorStatus: 404})
+	if err := dldr.Download(nil); err == nil {
+		t.Error("Download should fail")
+	}
+	if len(sink.calls) != 2 || sink.calls[1] != "Abort" || sink.Bytes() != nil {
+		t.Error("The sink should be aborted, got", sink.calls)
+	}
+}
+
+func TestOpenFileSink (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "sink")
+	failOnError(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	_, err = downloadElQuijote(t, []string{server.FileURL("quijote.txt")}, WithConnections(4), WithSink(NewOpenFileSink(file)),
+		WithRetryPolicy(fastRetryPolicy()))
+	failOnError(t, err)
+	compareElQuijote(t, file.Name())
+}
+
+func TestFileSink (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+
+	filename := "___sinkFile___"
+	sink := NewFileSink(filename, filename + ".tmp")
+	_, err := downloadElQuijote(t, []string{server.FileURL("quijote.txt")}, WithConnections(4), WithSink(sink),
+		WithRetryPolicy(fastRetryPolicy()))
+	failOnError(t, err)
+	defer os.Remove(filename)
+	compareElQuijote(t, filename)
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Error("The temporary file should be renamed")
+	}
+}
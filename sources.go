@@ -0,0 +1,203 @@
+package multipartdownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// What has been learnt about a source while downloading
+type sourceState struct {
+	host string      // Host of the URL, shared by other sources on the same server
+	noRanges bool    // Answers range requests with the whole file
+	limiter *RateLimiter  // Bandwidth limit of the source
+}
+
+// Connections to a host, shared by all its sources
+type hostState struct {
+	limit int        // Maximum concurrent connections, 0 if unknown
+	active int       // Open connections
+}
+
+// Start a download knowing nothing about the sources, except the given host limits
+func (dldr *MultiDownloader) initSources() {
+	dldr.sourcesMu.Lock()
+	defer dldr.sourcesMu.Unlock()
+	dldr.sources = make([]sourceState, len(dldr.urls))
+	dldr.hosts = make(map[string]*hostState)
+	for u, rawurl := range dldr.urls {
+		host := rawurl
+		if parsed, err := url.Parse(rawurl); err == nil {
+			host = parsed.Host
+		}
+		dldr.sources[u].host = host
+		dldr.sources[u].noRanges = u < len(dldr.rangeless) && dldr.rangeless[u]
+		dldr.sources[u].limiter = NewRateLimiter(dldr.sourceRate)
+		if dldr.hosts[host] == nil {
+			dldr.hosts[host] = &hostState{limit: dldr.hostLimit(host)}
+		}
+	}
+}
+
+// Bandwidth limiter of a source
+func (dldr *MultiDownloader) sourceLimiter(u int) *RateLimiter {
+	dldr.sourcesMu.Lock()
+	defer dldr.sourcesMu.Unlock()
+	return dldr.sources[u].limiter
+}
+
+// Respect the total and per source bandwidth limits, for n bytes received from a source
+func (dldr *MultiDownloader) waitBandwidth(ctx context.Context, u int, n int) {
+	dldr.rateLimiter.WaitN(ctx, n)
+	dldr.sourceLimiter(u).WaitN(ctx, n)
+}
+
+// Change the total bandwidth limit in bytes per second, 0 for unlimited. It takes
+// effect immediately if a download is running.
+func (dldr *MultiDownloader) SetRateLimit(bytesPerSecond int64) {
+	dldr.rateLimiter.SetRate(bytesPerSecond)
+}
+
+// Change the bandwidth limit of each source in bytes per second, 0 for unlimited. It
+// takes effect immediately if a download is running.
+func (dldr *MultiDownloader) SetSourceRateLimit(bytesPerSecond int64) {
+	dldr.sourcesMu.Lock()
+	defer dldr.sourcesMu.Unlock()
+	dldr.sourceRate = bytesPerSecond
+	for _, s := range dldr.sources {
+		s.limiter.SetRate(bytesPerSecond)
+	}
+}
+
+// Configured limit of a host, given either as "name:port" or "name"
+func (dldr *MultiDownloader) hostLimit(host string) int {
+	if limit, ok := dldr.hostLimits[host]; ok {
+		return limit
+	}
+	if parsed, err := url.Parse("//" + host); err == nil {
+		return dldr.hostLimits[parsed.Hostname()]
+	}
+	return 0
+}
+
+// Take a connection to the host of a source, unless it is at its limit
+func (dldr *MultiDownloader) acquireSource(u int) bool {
+	dldr.sourcesMu.Lock()
+	defer dldr.sourcesMu.Unlock()
+	h := dldr.hosts[dldr.sources[u].host]
+	if h.limit > 0 && h.active >= h.limit {
+		return false
+	}
+	h.active++
+	return true
+}
+
+// Give back a connection to the host of a source, learning its limit from the error
+// that ended the connection. Returns whether the host refused it for being at its limit.
+func (dldr *MultiDownloader) releaseSource(u int, err error) (limited bool) {
+	dldr.sourcesMu.Lock()
+	defer dldr.sourcesMu.Unlock()
+	host := dldr.sources[u].host
+	h := dldr.hosts[host]
+	h.active--
+	// Refusals are only blamed on the limit if other connections are open
+	if !isLimitError(err) || h.active == 0 {
+		return false
+	}
+	if h.limit == 0 || h.active < h.limit {
+		h.limit = h.active
+		dldr.logVerbose("Limiting connections to ", host, " to ", h.limit)
+	}
+	return true
+}
+
+// Whether an error is a refusal for too many connections
+func isLimitError(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode == http.StatusServiceUnavailable
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// Remember that a source ignores range requests
+func (dldr *MultiDownloader) setNoRanges(u int) {
+	dldr.sourcesMu.Lock()
+	defer dldr.sourcesMu.Unlock()
+	if !dldr.sources[u].noRanges {
+		dldr.logVerbose("Source ", dldr.urls[u], " doesn't support range requests")
+	}
+	dldr.sources[u].noRanges = true
+}
+
+// Remember that a source supports range requests after all
+func (dldr *MultiDownloader) setRanges(u int) {
+	dldr.sourcesMu.Lock()
+	defer dldr.sourcesMu.Unlock()
+	dldr.sources[u].noRanges = false
+}
+
+// Whether a source is known to ignore range requests
+func (dldr *MultiDownloader) noRanges(u int) bool {
+	dldr.sourcesMu.Lock()
+	defer dldr.sourcesMu.Unlock()
+	return dldr.sources[u].noRanges
+}
+
+// Whether GatherInfo found that no source supports range requests, so the file can only
+// be downloaded through a single connection
+func (dldr *MultiDownloader) noRangeSupport() bool {
+	for _, rangeless := range dldr.rangeless {
+		if !rangeless {
+			return false
+		}
+	}
+	return len(dldr.rangeless) > 0
+}
+
+// Whether any source is known to ignore range requests
+func (dldr *MultiDownloader) anyNoRanges() bool {
+	dldr.sourcesMu.Lock()
+	defer dldr.sourcesMu.Unlock()
+	for _, s := range dldr.sources {
+		if s.noRanges {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a Content-Range header: "bytes first-last/total", the total being -1 if unknown ("*")
+func parseContentRange(header string) (first int64, last int64, total int64, err error) {
+	invalid := fmt.Errorf("Invalid Content-Range %q", header)
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, 0, invalid
+	}
+	slash := strings.Split(strings.TrimPrefix(header, "bytes "), "/")
+	if len(slash) != 2 {
+		return 0, 0, 0, invalid
+	}
+	dash := strings.Split(slash[0], "-")
+	if len(dash) != 2 {
+		return 0, 0, 0, invalid
+	}
+	if first, err = strconv.ParseInt(dash[0], 10, 64); err != nil {
+		return 0, 0, 0, invalid
+	}
+	if last, err = strconv.ParseInt(dash[1], 10, 64); err != nil || last < first {
+		return 0, 0, 0, invalid
+	}
+	if slash[1] == "*" {
+		return first, last, -1, nil
+	}
+	if total, err = strconv.ParseInt(slash[1], 10, 64); err != nil || total <= last {
+		return 0, 0, 0, invalid
+	}
+	return first, last, total, nil
+}
@@ -0,0 +1,122 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+func TestParseContentRange (t *testing.T) {
+	testTable := []struct {
+		header string
+		first, last, total int64
+		valid bool
+	} {
+		{"bytes 0-499/1234", 0, 499, 1234, true},
+		{"bytes 500-1233/1234", 500, 1233, 1234, true},
+		{"bytes 42-42/*", 42, 42, -1, true},
+		{"bytes 0-1234/1234", 0, 0, 0, false},
+		{"bytes 10-5/1234", 0, 0, 0, false},
+		{"bytes */1234", 0, 0, 0, false},
+		{"items 0-1/2", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	}
+	for _, test := range testTable {
+		first, last, total, err := parseContentRange(test.header)
+		if (err == nil) != test.valid || first != test.first || last != test.last || total != test.total {
+			t.Error("Wrong parsing of", test.header, ":", first, last, total, err)
+		}
+	}
+}
+
+// A server ignoring ranges sends the whole file through a single connection
+func TestIgnoredRange (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{IgnoreRange: true})
+	defer server.Close()
+	defer os.Remove("quijote.txt")
+
+	for _, n := range []int{1, 4} {
+		if _, err := downloadElQuijote(t, []string{server.FileURL("quijote.txt")}, WithConnections(n),
+			WithRetryPolicy(fastRetryPolicy())); err != nil {
+			t.Error("Download with", n, "connections from a server ignoring ranges failed:", err)
+		}
+	}
+}
+
+// A server answering the wrong range is not trusted
+func TestWrongContentRange (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	wrong := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var first, last int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); err == nil {
+			r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first + 1, last))
+		}
+		http.ServeContent(w, r, "quijote.txt", time.Time{}, bytes.NewReader(reference))
+	}))
+	defer wrong.Close()
+	good := testserver.New("test", testserver.Faults{})
+	defer good.Close()
+	defer os.Remove("quijote.txt")
+
+	options := []Option{WithConnections(2), WithRetryPolicy(fastRetryPolicy())}
+	if _, err := downloadElQuijote(t, []string{wrong.URL + "/quijote.txt"}, options...); err == nil {
+		t.Error("Download from a server sending wrong ranges should fail")
+	}
+	if _, err := downloadElQuijote(t, []string{wrong.URL + "/quijote.txt", good.FileURL("quijote.txt")}, options...); err != nil {
+		t.Error("Download should use the source sending the right ranges:", err)
+	}
+}
+
+// Connections refused by a host set its limit for the rest of the download
+func TestLearnHostLimit (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{BytesPerSecond: 4 << 20})
+	defer server.Close()
+
+	urls := []string{server.FileURL("quijote.txt"), server.FileURL("quijote2.txt")}
+	dldr := New(urls, WithConnections(8), WithChunkSize(1 << 14), WithRetryPolicy(fastRetryPolicy()))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___limitFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+
+	server.SetFaults(testserver.Faults{BytesPerSecond: 4 << 20, MaxConnections: 3})
+	err = dldr.Download(nil)
+	failOnError(t, err)
+	compareElQuijote(t, dldr.filename)
+	// Only the first connections over the limit are refused
+	if rejected := server.Rejected(); rejected > 5 {
+		t.Error("The host limit should be learnt, but", rejected, "connections were refused")
+	}
+}
+
+// All sources on a host share its configured limit
+func TestHostLimit (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{BytesPerSecond: 4 << 20})
+	defer server.Close()
+
+	urls := []string{server.FileURL("quijote.txt"), server.FileURL("quijote2.txt")}
+	host := strings.TrimPrefix(server.URL, "http://")
+	dldr := New(urls, WithConnections(8), WithChunkSize(1 << 14), WithHostLimit(host, 2))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___limitFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+
+	err = dldr.Download(nil)
+	failOnError(t, err)
+	compareElQuijote(t, dldr.filename)
+	if max := server.MaxActive(); max > 2 {
+		t.Error("The host limit is 2 connections, but", max, "were open")
+	}
+}
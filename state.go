@@ -0,0 +1,122 @@
+package multipartdownloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const stateFileSuffix = ".state"
+
+// Progress of a single chunk, as stored in the state file
+type chunkState struct {
+	Begin int64    `json:"begin"`
+	End int64      `json:"end"`
+	Current int64  `json:"current"`
+}
+
+// Persistent download state, stored next to the .part file so an interrupted
+// download can be resumed fetching only the missing byte ranges
+type downloadState struct {
+	ETag string            `json:"etag"`
+	FileLength int64       `json:"fileLength"`
+	Chunks []chunkState    `json:"chunks"`
+}
+
+// Load a state file. A missing file is not an error: it returns a nil state.
+func loadState(filename string) (*downloadState, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &downloadState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("Corrupt download state %s: %v", filename, err)
+	}
+	return state, nil
+}
+
+// Write the state file atomically, so a crash never leaves it half-written
+func (state *downloadState) save(filename string) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpFilename := filename + ".tmp"
+	if err := ioutil.WriteFile(tmpFilename, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// Check that a previous state describes the same remote file and a sane chunks table
+func (state *downloadState) validate(etag string, fileLength int64) error {
+	if state.ETag != etag || state.FileLength != fileLength {
+		return fmt.Errorf("Remote file changed since the download started (ETag %q -> %q, length %d -> %d)",
+			state.ETag, etag, state.FileLength, fileLength)
+	}
+	if len(state.Chunks) == 0 {
+		return fmt.Errorf("Download state has no chunks")
+	}
+	boundary := int64(0)
+	for _, c := range state.Chunks {
+		if c.Begin != boundary || c.End < c.Begin || c.Current < c.Begin || c.Current > c.End {
+			return fmt.Errorf("Download state has an invalid chunk %d-%d", c.Begin, c.End)
+		}
+		boundary = c.End
+	}
+	if boundary != fileLength {
+		return fmt.Errorf("Download state chunks do not cover the whole file")
+	}
+	return nil
+}
+
+// Name of the state file that accompanies the .part file
+func (dldr *MultiDownloader) stateFilename() string {
+	return dldr.partFilename + stateFileSuffix
+}
+
+// Take a consistent snapshot of the current chunks progress
+func (dldr *MultiDownloader) snapshotState() *downloadState {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	state := &downloadState{
+		ETag: dldr.ETag,
+		FileLength: dldr.fileLength,
+		Chunks: make([]chunkState, len(dldr.chunks)),
+	}
+	for i, c := range dldr.chunks {
+		current := dldr.current[i]
+		// Only verified pieces are kept: a partial piece is downloaded again
+		if dldr.pieceHashes != nil && current < c.End {
+			if begin := dldr.pieceHashes.pieceBegin(current); begin >= c.Begin {
+				current = begin
+			}
+		}
+		state.Chunks[i] = chunkState{c.Begin, c.End, current}
+	}
+	// Chunks split by idle connections are appended to the table, out of file order
+	sort.Slice(state.Chunks, func(i, j int) bool {
+		return state.Chunks[i].Begin < state.Chunks[j].Begin
+	})
+	return state
+}
+
+// Adopt the chunks table and progress of a previous run
+func (dldr *MultiDownloader) restoreState(state *downloadState) {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	dldr.chunks = make([]Chunk, len(state.Chunks))
+	dldr.current = make([]int64, len(state.Chunks))
+	dldr.active = make([]bool, len(state.Chunks))
+	dldr.nextPending = 0
+	for i, c := range state.Chunks {
+		dldr.chunks[i] = Chunk{c.Begin, c.End}
+		dldr.current[i] = c.Current
+	}
+}
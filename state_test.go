@@ -0,0 +1,102 @@
+package multipartdownloader
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+// Simulate an interrupted run: half of every chunk is on disk and recorded in the state
+func interruptedDownload(t *testing.T, url string, filename string, nConns int) []byte {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+
+	dldr := setupElQuijote(t, filename, []string{url}, WithConnections(nConns))
+	file, err := os.OpenFile(dldr.partFilename, os.O_WRONLY, 0666)
+	failOnError(t, err)
+	defer file.Close()
+	for i, c := range dldr.chunks {
+		half := c.Begin + (c.End - c.Begin) / 2
+		_, err = file.WriteAt(reference[c.Begin:half], c.Begin)
+		failOnError(t, err)
+		dldr.setCurrent(i, half)
+	}
+	failOnError(t, dldr.snapshotState().save(dldr.stateFilename()))
+	return reference
+}
+
+func TestResumeDownload (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+
+	filename := "___resumeFile___"
+	reference := interruptedDownload(t, server.FileURL("quijote.txt"), filename, 4)
+	defer os.Remove(filename)
+
+	// A new run with a different number of connections adopts the saved chunks table
+	dldr := NewMultiDownloader([]string{server.FileURL("quijote.txt")}, 2, time.Duration(5000) * time.Millisecond)
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	sentBefore := server.Sent()
+	_, err = dldr.SetupFile(filename)
+	failOnError(t, err)
+	if len(dldr.Chunks()) != 4 {
+		t.Fatal("The chunks table of the previous run should be restored")
+	}
+	err = dldr.Download(nil)
+	failOnError(t, err)
+
+	compareElQuijote(t, filename)
+	if sent := server.Sent() - sentBefore; sent >= int64(len(reference)) {
+		t.Error("Resumed download should fetch only the missing ranges, got", sent, "bytes")
+	}
+	if _, err := os.Stat(dldr.stateFilename()); !os.IsNotExist(err) {
+		t.Error("State file should be removed after a successful download")
+	}
+}
+
+func TestResumeMismatch (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+
+	filename := "___resumeFile___"
+	interruptedDownload(t, server.FileURL("quijote.txt"), filename, 2)
+	defer os.Remove(filename + tmpFileSuffix)
+	defer os.Remove(filename + tmpFileSuffix + stateFileSuffix)
+
+	// The same name now points to a different file
+	dldr := NewMultiDownloader([]string{server.FileURL("quijote.txt")}, 2, time.Duration(5000) * time.Millisecond)
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	dldr.fileLength++
+	if _, err := dldr.SetupFile(filename); err == nil {
+		t.Error("Resuming should be refused when the remote file length changed")
+	}
+	dldr.fileLength--
+	dldr.ETag = "changed"
+	if _, err := dldr.SetupFile(filename); err == nil {
+		t.Error("Resuming should be refused when the remote ETag changed")
+	}
+}
+
+// A state saved after some chunks were split can be resumed
+func TestResumeAfterSplit (t *testing.T) {
+	dldr := New([]string{"http://localhost/file"}, WithConnections(2))
+	dldr.fileLength = 1 << 20
+	dldr.buildChunks()
+	for i := range dldr.chunks {
+		dldr.nextChunk()
+		// The first chunk has the most bytes left
+		dldr.setCurrent(i, dldr.chunks[i].End - int64(len(dldr.chunks) - i) * minStealSize)
+	}
+	i, victim, ok := dldr.nextChunk()
+	if !ok || victim != 0 {
+		t.Fatal("The first chunk should be split, got", victim)
+	}
+	dldr.setCurrent(i, dldr.chunks[i].Begin + 10)
+	state := dldr.snapshotState()
+	failOnError(t, state.validate(dldr.ETag, dldr.fileLength))
+}
@@ -0,0 +1,269 @@
+package multipartdownloader
+
+import (
+	"time"
+)
+
+const (
+	rateBucket = 500 * time.Millisecond
+	rateBuckets = 10          // Rates are measured over the last 5 seconds
+)
+
+// Transfer statistics of a connection or a source
+type TransferStats struct {
+	Bytes int64                      // Bytes received
+	Rate float64                     // Bytes per second over the last seconds
+	AverageRate float64              // Bytes per second since the first request
+	Requests int
+	Errors int                       // Requests that failed, not counting cancelled ones
+	FirstByteLatency time.Duration   // Average time from a request to its response
+}
+
+// Statistics of one of the parallel connections of a download
+type ConnectionStats struct {
+	Id int
+	URL string                       // Source being downloaded from, empty if idle
+	Chunk int                        // Chunk being downloaded, as the Id of ConnectionProgress, -1 if idle
+	TransferStats
+}
+
+// Statistics of a source of a download
+type SourceStats struct {
+	URL string
+	TransferStats
+}
+
+// Statistics of a download, see Stats
+type Stats struct {
+	Length int64                     // Length of the file, -1 if unknown
+	Downloaded int64                 // Bytes of the file downloaded, including those of a resumed download
+	Rate float64                     // Bytes per second over the last seconds
+	AverageRate float64              // Bytes per second since the download started
+	Started time.Time                // When the download started, zero if none did yet
+	Elapsed time.Duration            // Time since the download started
+	ETA time.Duration                // Estimated time left at the current rate, -1 if unknown
+	Connections []ConnectionStats
+	Sources []SourceStats
+}
+
+// Bytes received over time, measuring the rate over a sliding window
+type rateMeter struct {
+	start time.Time                  // Time of the first bytes
+	total int64
+	buckets [rateBuckets]int64       // Bytes received in the last periods of rateBucket
+	last int64                       // Period of the latest bytes, counted from start
+}
+
+func (m *rateMeter) period(now time.Time) int64 {
+	return int64(now.Sub(m.start) / rateBucket)
+}
+
+func (m *rateMeter) add(n int64, now time.Time) {
+	if m.start.IsZero() {
+		m.start = now
+	}
+	p := m.period(now)
+	if p - m.last >= rateBuckets {
+		m.buckets = [rateBuckets]int64{}
+	} else {
+		for i := m.last + 1; i <= p; i++ {
+			m.buckets[i % rateBuckets] = 0
+		}
+	}
+	if p > m.last {
+		m.last = p
+	}
+	m.buckets[m.last % rateBuckets] += n
+	m.total += n
+}
+
+// Bytes per second over the window, or since the first bytes if more recent
+func (m *rateMeter) rate(now time.Time) float64 {
+	if m.start.IsZero() {
+		return 0
+	}
+	var sum int64
+	for i := m.period(now) - rateBuckets + 1; i <= m.last; i++ {
+		if i >= 0 {
+			sum += m.buckets[i % rateBuckets]
+		}
+	}
+	span := rateBucket * rateBuckets
+	if elapsed := now.Sub(m.start); elapsed < span {
+		span = elapsed
+	}
+	// A few bytes right after the start don't make a rate
+	if span < rateBucket {
+		span = rateBucket
+	}
+	return float64(sum) / span.Seconds()
+}
+
+// Statistics being gathered for a connection or a source
+type transferTracker struct {
+	meter rateMeter
+	first time.Time                  // Time of the first request
+	requests int
+	errors int
+	responses int
+	latency time.Duration            // Sum of the latencies of the responses
+}
+
+func (t *transferTracker) request(now time.Time) {
+	if t.first.IsZero() {
+		t.first = now
+	}
+	t.requests++
+}
+
+func (t *transferTracker) stats(now time.Time) TransferStats {
+	s := TransferStats{
+		Bytes: t.meter.total,
+		Rate: t.meter.rate(now),
+		Requests: t.requests,
+		Errors: t.errors,
+	}
+	if elapsed := now.Sub(t.first); !t.first.IsZero() && elapsed > 0 {
+		s.AverageRate = float64(t.meter.total) / elapsed.Seconds()
+	}
+	if t.responses > 0 {
+		s.FirstByteLatency = t.latency / time.Duration(t.responses)
+	}
+	return s
+}
+
+// Statistics being gathered for a download
+type downloadStats struct {
+	start time.Time
+	length int64                     // Length of the file, -1 if unknown
+	written rateMeter                // Bytes of the file written
+	connections []transferTracker
+	connURLs []int                   // Source of each connection, -1 if idle
+	connChunks []int                 // Chunk of each connection, -1 if idle
+	sources []transferTracker        // By index of the urls
+	urls []string                    // Sources of the download, as another GatherInfo may change them
+}
+
+// Get the statistics of the current or last download
+//
+// The rates are measured over the last few seconds, so they reflect a change of speed
+// quickly. The ETA is estimated from that rate.
+func (dldr *MultiDownloader) Stats() Stats {
+	// The progress includes the bytes written by a previous run of a resumed download
+	downloaded, chunks := int64(0), 0
+	for _, p := range dldr.progressSnapshot() {
+		downloaded += p.Current - p.Begin
+		chunks++
+	}
+
+	dldr.statsMu.Lock()
+	defer dldr.statsMu.Unlock()
+	st := &dldr.stats
+	now := time.Now()
+	if chunks == 0 {
+		downloaded = st.written.total
+	}
+	stats := Stats{
+		Length: st.length,
+		Downloaded: downloaded,
+		Rate: st.written.rate(now),
+		ETA: -1,
+	}
+	if st.start.IsZero() {
+		// No download yet
+		stats.Length = -1
+		return stats
+	}
+	stats.Started = st.start
+	stats.Elapsed = now.Sub(st.start)
+	if stats.Elapsed > 0 {
+		stats.AverageRate = float64(st.written.total) / stats.Elapsed.Seconds()
+	}
+	if st.length >= 0 && downloaded >= st.length {
+		stats.ETA = 0
+	} else if st.length >= 0 && stats.Rate > 0 {
+		stats.ETA = time.Duration(float64(st.length - downloaded) / stats.Rate * float64(time.Second))
+	}
+
+	for c := range st.connections {
+		conn := ConnectionStats{Id: c, Chunk: st.connChunks[c], TransferStats: st.connections[c].stats(now)}
+		if u := st.connURLs[c]; u >= 0 {
+			conn.URL = st.urls[u]
+		}
+		stats.Connections = append(stats.Connections, conn)
+	}
+	for u := range st.sources {
+		stats.Sources = append(stats.Sources, SourceStats{st.urls[u], st.sources[u].stats(now)})
+	}
+	return stats
+}
+
+// Internal: start gathering the statistics of a download
+func (dldr *MultiDownloader) initStats() {
+	nConns := dldr.nConns
+	if nConns < 1 {
+		nConns = 1
+	}
+	dldr.statsMu.Lock()
+	defer dldr.statsMu.Unlock()
+	dldr.stats = downloadStats{
+		start: time.Now(),
+		length: dldr.fileLength,
+		connections: make([]transferTracker, nConns),
+		connURLs: make([]int, nConns),
+		connChunks: make([]int, nConns),
+		sources: make([]transferTracker, len(dldr.urls)),
+		urls: append([]string(nil), dldr.urls...),
+	}
+	for c := range dldr.stats.connURLs {
+		dldr.stats.connURLs[c], dldr.stats.connChunks[c] = -1, -1
+	}
+}
+
+// Internal: the length of the file was found while downloading
+func (dldr *MultiDownloader) statsLength(length int64) {
+	dldr.statsMu.Lock()
+	dldr.stats.length = length
+	dldr.statsMu.Unlock()
+}
+
+// Internal: connection c requests chunk i from source u
+func (dldr *MultiDownloader) statsRequest(c int, u int, i int) {
+	now := time.Now()
+	dldr.statsMu.Lock()
+	defer dldr.statsMu.Unlock()
+	dldr.stats.connections[c].request(now)
+	dldr.stats.sources[u].request(now)
+	dldr.stats.connURLs[c], dldr.stats.connChunks[c] = u, i
+}
+
+// Internal: the response to a request of connection c arrived after latency
+func (dldr *MultiDownloader) statsResponse(c int, u int, latency time.Duration) {
+	dldr.statsMu.Lock()
+	defer dldr.statsMu.Unlock()
+	for _, t := range []*transferTracker{&dldr.stats.connections[c], &dldr.stats.sources[u]} {
+		t.responses++
+		t.latency += latency
+	}
+}
+
+// Internal: connection c wrote n bytes from source u
+func (dldr *MultiDownloader) statsReceived(c int, u int, n int) {
+	now := time.Now()
+	dldr.statsMu.Lock()
+	defer dldr.statsMu.Unlock()
+	dldr.stats.connections[c].meter.add(int64(n), now)
+	dldr.stats.sources[u].meter.add(int64(n), now)
+	dldr.stats.written.add(int64(n), now)
+}
+
+// Internal: the request of connection c ended, having failed if err is not nil
+func (dldr *MultiDownloader) statsDone(c int, u int, err error) {
+	dldr.statsMu.Lock()
+	defer dldr.statsMu.Unlock()
+	if err != nil {
+		dldr.stats.connections[c].errors++
+		dldr.stats.sources[u].errors++
+	}
+	dldr.stats.connURLs[c], dldr.stats.connChunks[c] = -1, -1
+}
@@ -0,0 +1,124 @@
+package multipartdownloader
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+func TestRateMeter (t *testing.T) {
+	var m rateMeter
+	start := time.Now()
+	// 10 KB/s for 10 seconds, then nothing
+	for i := 0; i < 100; i++ {
+		m.add(1000, start.Add(time.Duration(i) * 100 * time.Millisecond))
+	}
+	now := start.Add(10 * time.Second)
+	if rate := m.rate(now); math.Abs(rate - 10000) > 1000 {
+		t.Error("The rate should be about 10000 B/s, got", rate)
+	}
+	if rate := m.rate(start.Add(time.Second)); rate == 0 {
+		t.Error("The rate should be measured from the first bytes")
+	}
+	if rate := m.rate(now.Add(10 * time.Second)); rate != 0 {
+		t.Error("The rate should drop to 0 after a while without bytes, got", rate)
+	}
+	// A burst after the pause is only measured over the window
+	m.add(5000, now.Add(20 * time.Second))
+	if rate := m.rate(now.Add(20 * time.Second)); rate != 1000 {
+		t.Error("The burst should be measured over 5 seconds, got", rate)
+	}
+	if m.total != 105000 {
+		t.Error("Wrong total:", m.total)
+	}
+}
+
+// Statistics of the download, its connections and its sources
+func TestStats (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{BytesPerSecond: 1 << 19})
+	defer server.Close()
+	dropping := testserver.New("test", testserver.Faults{DropAfter: 1000, DropCount: 1, BytesPerSecond: 1 << 19})
+	defer dropping.Close()
+
+	urls := []string{server.FileURL("quijote.txt"), dropping.FileURL("quijote.txt")}
+	dldr := New(urls, WithConnections(2), WithRetryPolicy(fastRetryPolicy()))
+	if stats := dldr.Stats(); stats.Length != -1 || stats.ETA != -1 || !stats.Started.IsZero() {
+		t.Error("Without a download, the length and ETA should be unknown, got", stats)
+	}
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	_, err = dldr.SetupFile("___statsFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+
+	var during Stats
+	failOnError(t, dldr.Download(func(progress []ConnectionProgress) {
+		if during.Downloaded < dldr.fileLength / 2 {
+			during = dldr.Stats()
+		}
+	}))
+	if during.Rate <= 0 || during.ETA <= 0 || during.Length != dldr.fileLength {
+		t.Error("The rate and ETA should be known while downloading, got", during)
+	}
+	busy := false
+	for _, c := range during.Connections {
+		busy = busy || (c.URL != "" && c.Chunk >= 0)
+	}
+	if !busy {
+		t.Error("The connections should tell what they download, got", during.Connections)
+	}
+
+	stats := dldr.Stats()
+	if stats.Downloaded != dldr.fileLength || stats.ETA != 0 || stats.AverageRate <= 0 || stats.Started.IsZero() ||
+		len(stats.Connections) != 2 {
+		t.Error("Wrong statistics of the completed download:", stats)
+	}
+	var bytes int64
+	for _, c := range stats.Connections {
+		if c.URL != "" || c.Chunk != -1 {
+			t.Error("The connections should be idle, got", c)
+		}
+		bytes += c.Bytes
+	}
+	if bytes != dldr.fileLength {
+		t.Error("The connections should have received", dldr.fileLength, "bytes, got", bytes)
+	}
+	if len(stats.Sources) != 2 {
+		t.Fatal("Statistics of both sources were expected, got", stats.Sources)
+	}
+	for u, s := range stats.Sources {
+		if s.URL != urls[u] || s.Requests == 0 || s.Bytes == 0 || s.FirstByteLatency <= 0 || s.AverageRate <= 0 {
+			t.Error("Wrong statistics of a source:", s)
+		}
+	}
+	if stats.Sources[0].Errors != 0 || stats.Sources[1].Errors != 1 {
+		t.Error("The failed request should be counted, got", stats.Sources)
+	}
+}
+
+// The statistics of the last download are kept after probing fewer sources again
+func TestStatsAfterGatherInfo (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	other := testserver.New("test", testserver.Faults{})
+	defer other.Close()
+
+	urls := []string{server.FileURL("quijote.txt"), other.FileURL("quijote.txt")}
+	dldr, err := downloadElQuijote(t, urls, WithConnections(2), WithQuorum(1))
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+
+	other.SetFaults(testserver.Faults{ErrorStatus: 404})
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	if len(dldr.urls) != 1 {
+		t.Fatal("The failing source should be excluded, got", dldr.urls)
+	}
+	stats := dldr.Stats()
+	if len(stats.Sources) != 2 || stats.Sources[0].URL != urls[0] || stats.Sources[1].URL != urls[1] {
+		t.Error("The sources of the last download should be reported, got", stats.Sources)
+	}
+}
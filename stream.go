@@ -0,0 +1,182 @@
+package multipartdownloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const defaultStreamBuffer = 16 << 20
+
+// Hands data written at arbitrary offsets to a sequential writer, in order. Data arriving
+// ahead of the writer position is held in memory until the gap before it is filled.
+type orderedWriter struct {
+	w io.Writer
+	mu sync.Mutex
+	offset int64              // Offset of the next byte to be written to w
+	pending map[int64][]byte  // Data received ahead of the offset, by its offset
+	err error                 // Error of w, returned by all later writes
+	advance func(int64)       // Called with the new offset whenever it moves forward
+}
+
+func newOrderedWriter(w io.Writer, advance func(int64)) *orderedWriter {
+	return &orderedWriter{w: w, pending: make(map[int64][]byte), advance: advance}
+}
+
+func (ow *orderedWriter) WriteAt(p []byte, off int64) (int, error) {
+	ow.mu.Lock()
+	if ow.err != nil {
+		ow.mu.Unlock()
+		return 0, ow.err
+	}
+	n := len(p)
+	if off > ow.offset {
+		// The buffer of the caller is reused for the following data
+		ow.pending[off] = append([]byte(nil), p...)
+		ow.mu.Unlock()
+		return n, nil
+	}
+
+	// Data written again from an earlier offset, when falling back to a single connection
+	if off < ow.offset {
+		if off + int64(len(p)) <= ow.offset {
+			ow.mu.Unlock()
+			return n, nil
+		}
+		p = p[ow.offset - off:]
+		for o := range ow.pending {
+			if o < ow.offset {
+				delete(ow.pending, o)
+			}
+		}
+	}
+	for {
+		if _, err := ow.w.Write(p); err != nil {
+			ow.err = err
+			ow.mu.Unlock()
+			return 0, err
+		}
+		ow.offset += int64(len(p))
+		next, ok := ow.pending[ow.offset]
+		if !ok {
+			break
+		}
+		delete(ow.pending, ow.offset)
+		p = next
+	}
+	offset := ow.offset
+	ow.mu.Unlock()
+	ow.advance(offset)
+	return n, nil
+}
+
+// Offset of the next byte to be written
+func (ow *orderedWriter) position() int64 {
+	ow.mu.Lock()
+	defer ow.mu.Unlock()
+	return ow.offset
+}
+
+// Perform the multipart download, writing the file to w in order instead of to a file
+//
+// Chunks are still downloaded in parallel. Data arriving ahead of the bytes written so far
+// is kept in memory, up to the size set with WithStreamBuffer: connections don't start
+// chunks too far ahead until the ones before them are written. Chunks are sized so that
+// several connections fit in that memory, with the chunk size set with WithChunkSize
+// as a maximum.
+//
+// Nothing is written to disk, so a stopped download can't be resumed, and the file can only
+// be verified with the digests requested by WithHashes.
+func (dldr *MultiDownloader) DownloadTo(w io.Writer, feedbackFunc func ([]ConnectionProgress)) error {
+	return dldr.DownloadToContext(context.Background(), w, feedbackFunc)
+}
+
+// Perform the multipart download to a writer, stopping when the context is cancelled
+func (dldr *MultiDownloader) DownloadToContext(ctx context.Context, w io.Writer, feedbackFunc func ([]ConnectionProgress)) (err error) {
+	defer func() {
+		dldr.emitDownloadResult(err)
+	}()
+	if dldr.streamBuffer < 2 {
+		return errors.New("The stream buffer is too small")
+	}
+
+	// Smaller chunks than usual, so that every connection can work within the buffer
+	chunkSize := dldr.streamBuffer / int64(2 * dldr.nConns)
+	if dldr.chunkSize > 0 && dldr.chunkSize < chunkSize {
+		chunkSize = dldr.chunkSize
+	}
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	// Kept while downloading, in case the chunks are only built once the length is known
+	savedChunkSize := dldr.chunkSize
+	dldr.chunkSize = chunkSize
+	defer func() {
+		dldr.chunkSize = savedChunkSize
+	}()
+	// A chunk begins within the window, and the data written past the stream position can
+	// reach its end at most
+	dldr.progressMu.Lock()
+	dldr.buildChunks()
+	dldr.streamWindow = dldr.streamBuffer - chunkSize
+	dldr.streamEnd = dldr.streamWindow
+	dldr.streamCond = sync.NewCond(&dldr.progressMu)
+	dldr.streamStopped = false
+	dldr.progressMu.Unlock()
+	defer func() {
+		dldr.progressMu.Lock()
+		dldr.streamWindow = 0
+		dldr.streamCond = nil
+		dldr.progressMu.Unlock()
+	}()
+
+	// The data reaches the writer in order, so it can always be hashed on the way
+	dldr.digests = nil
+	var hashes *inlineHashes
+	if len(dldr.hashAlgorithms) > 0 {
+		if hashes, err = newInlineHashes(dldr.hashAlgorithms); err != nil {
+			return err
+		}
+		w = io.MultiWriter(w, hashes)
+	}
+	ow := newOrderedWriter(w, dldr.advanceStream)
+
+	// Wake up the connections waiting for the stream if it is stopped
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan bool)
+	defer func() {
+		cancel()
+		<- stopped
+	}()
+	go func() {
+		<- ctx.Done()
+		dldr.progressMu.Lock()
+		dldr.streamStopped = true
+		dldr.streamCond.Broadcast()
+		dldr.progressMu.Unlock()
+		close(stopped)
+	}()
+
+	if err := dldr.transfer(ctx, ow, feedbackFunc, nil); err != nil {
+		return err
+	}
+	if position := ow.position(); position != dldr.fileLength {
+		return fmt.Errorf("Only %d of %d bytes could be written in order", position, dldr.fileLength)
+	}
+	if hashes != nil {
+		dldr.digests = hashes.digests(dldr.fileLength)
+	}
+	return nil
+}
+
+// Let the connections start chunks up to a window past the new stream position
+func (dldr *MultiDownloader) advanceStream(offset int64) {
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	dldr.streamEnd = offset + dldr.streamWindow
+	if dldr.streamCond != nil {
+		dldr.streamCond.Broadcast()
+	}
+}
@@ -0,0 +1,142 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+// Writer counting the bytes written to it
+type countingWriter struct {
+	mu sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) written() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return int64(w.buf.Len())
+}
+
+func TestOrderedWriter (t *testing.T) {
+	var out bytes.Buffer
+	var advanced int64
+	ow := newOrderedWriter(&out, func(offset int64) { advanced = offset })
+	writes := []struct {
+		data string
+		off int64
+	} {
+		{"defgh", 3},
+		{"jk", 9},
+		{"abc", 0},
+		{"i", 8},
+		{"abcd", 0},  // Written again after a restart
+		{"efghijkl", 4},
+	}
+	for _, w := range writes {
+		n, err := ow.WriteAt([]byte(w.data), w.off)
+		if err != nil || n != len(w.data) {
+			t.Fatal("Writing", w.data, "failed:", n, err)
+		}
+	}
+	if out.String() != "abcdefghijkl" || advanced != 12 || ow.position() != 12 {
+		t.Error("Data should be written in order, got", out.String(), "up to", advanced)
+	}
+	if len(ow.pending) != 0 {
+		t.Error("No data should be left pending, got", len(ow.pending), "blocks")
+	}
+}
+
+func TestDownloadTo (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	// The first chunk arrives late, when the others are done
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		http.ServeContent(w, r, "quijote.txt", time.Time{}, bytes.NewReader(reference))
+	}))
+	defer server.Close()
+	urls := []string{server.URL + "/quijote.txt"}
+
+	for _, n := range []int{1, 4, 8} {
+		buffer := int64(64 << 10)
+		dldr := New(urls, WithConnections(n), WithStreamBuffer(buffer))
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+
+		// The data received but not written yet never exceeds the buffer
+		out := &countingWriter{}
+		var maxAhead int64
+		err = dldr.DownloadTo(out, func(progress []ConnectionProgress) {
+			received := int64(0)
+			for _, p := range progress {
+				received += p.Current - p.Begin
+			}
+			if ahead := received - out.written(); ahead > maxAhead {
+				maxAhead = ahead
+			}
+		})
+		failOnError(t, err)
+		if !bytes.Equal(reference, out.buf.Bytes()) {
+			t.Error("Streamed data with", n, "connections does not match the reference file")
+		}
+		if maxAhead > buffer {
+			t.Error("With", n, "connections", maxAhead, "bytes were held, more than the", buffer, "bytes buffer")
+		}
+	}
+}
+
+// Broken connections and sources ignoring ranges are handled as when writing a file
+func TestDownloadToFaults (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	for _, faults := range []testserver.Faults{
+		{DropAfter: 10000, DropCount: 10},
+		{IgnoreRange: true},
+	} {
+		server := testserver.New("test", faults)
+		dldr := New([]string{server.FileURL("quijote.txt")}, WithConnections(4),
+			WithStreamBuffer(64 << 10), WithRetryPolicy(fastRetryPolicy()))
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+		var out bytes.Buffer
+		failOnError(t, dldr.DownloadTo(&out, nil))
+		if !bytes.Equal(reference, out.Bytes()) {
+			t.Error("Streamed data does not match the reference file with faults", faults)
+		}
+		server.Close()
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("Disk full")
+}
+
+func TestDownloadToWriteError (t *testing.T) {
+	server := testserver.New("test", testserver.Faults{})
+	defer server.Close()
+	dldr := New([]string{server.FileURL("quijote.txt")}, WithConnections(4))
+	_, err := dldr.GatherInfo()
+	failOnError(t, err)
+	if err := dldr.DownloadTo(failingWriter{}, nil); err == nil || err.Error() != "Disk full" {
+		t.Error("The error of the writer should be returned, got", err)
+	}
+}
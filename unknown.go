@@ -0,0 +1,215 @@
+package multipartdownloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Download of a file whose length no source told
+//
+// The file is downloaded through a single connection, growing as the data arrives, until
+// the source closes it. The whole file is still requested as a range, "bytes=0-": a source
+// answering with a partial response telling the total length does support ranges, so the
+// rest of the file is then downloaded in parallel, keeping what was already written.
+//
+// Pieces can't be verified while the length is unknown, as the last piece can't be told.
+
+// Download the file through a single connection. Returns true if the file was completed,
+// false if the length was found and the chunks table built for a parallel download.
+func (dldr *MultiDownloader) transferUnknownLength(ctx context.Context, w io.WriterAt,
+	feedbackFunc func ([]ConnectionProgress)) (bool, error) {
+	var offset int64      // Bytes written so far
+	var received int64    // Bytes written by the last request
+	var latency time.Duration // Time the response to the last request took, 0 if none
+	length := int64(-1)   // Length of the body, if the response told it
+	var writeErr error
+
+	report := func() {
+		if feedbackFunc != nil {
+			feedbackFunc([]ConnectionProgress{{Id: 0, Begin: 0, End: length, Current: offset}})
+		}
+	}
+
+	// Request the rest of the file from a source and write it as it arrives. Returns the
+	// total length if the source tells it in a partial response, -1 otherwise.
+	fetch := func(u int) (int64, error) {
+		received, latency = 0, 0
+		url := dldr.urls[u]
+		req, err := dldr.newRequest(ctx, "GET", url)
+		if err != nil {
+			return -1, err
+		}
+		req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+		start := time.Now()
+		resp, err := dldr.client.Do(req)
+		if err != nil {
+			return -1, err
+		}
+		defer resp.Body.Close()
+		latency = time.Since(start)
+		dldr.statsResponse(0, u, latency)
+
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			first, _, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+			if err != nil {
+				return -1, fmt.Errorf("Source %s: %v", url, err)
+			}
+			if first != offset {
+				return -1, fmt.Errorf("Source %s sent range %s instead of bytes %d-",
+					url, resp.Header.Get("Content-Range"), offset)
+			}
+			if total >= 0 {
+				return total, nil
+			}
+		case http.StatusOK:
+			// The range was ignored: the body is the whole file
+			if offset > 0 {
+				dldr.setNoRanges(u)
+			}
+			offset = 0
+			length = contentLength(resp)
+		case http.StatusRequestedRangeNotSatisfiable:
+			// Nothing after the last byte: the file was already complete
+			if resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset) {
+				return offset, nil
+			}
+			return -1, newStatusError(url, resp)
+		default:
+			return -1, newStatusError(url, resp)
+		}
+
+		buf := make([]byte, dldr.bufferSize)
+		for {
+			// Not io.ReadFull, which can't tell a broken chunked body from the end of the file
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				dldr.waitBandwidth(ctx, u, n)
+			}
+			if ctx.Err() != nil {
+				return -1, ctx.Err()
+			}
+			if n > 0 {
+				if _, errWr := w.WriteAt(buf[:n], offset); errWr != nil {
+					writeErr = errWr
+					return -1, errWr
+				}
+				offset += int64(n)
+				received += int64(n)
+				dldr.statsReceived(0, u, n)
+				report()
+			}
+			if err == io.EOF {
+				// Without a length, only the source knows whether this is the end of the file
+				if length >= 0 && offset != length {
+					return -1, io.ErrUnexpectedEOF
+				}
+				return -1, nil
+			}
+			if err != nil {
+				return -1, err
+			}
+		}
+	}
+
+	// Try the sources in turn, retrying according to the retry policy
+	var lastErr error
+	skippedUrls := make(map[int]bool)
+	failures := attempts{policy: &dldr.retryPolicy}
+	requests := 0
+	for try := 0; len(skippedUrls) < len(dldr.urls); try++ {
+		u := try % len(dldr.urls)
+		if skippedUrls[u] {
+			continue
+		}
+		before := offset
+		if !dldr.connBudget.acquire(ctx) {
+			return false, &CanceledError{ctx.Err()}
+		}
+		requests++
+		if lastErr != nil {
+			dldr.emit(Event{Kind: EventChunkRetried, URL: dldr.urls[u], Attempt: requests, Err: lastErr})
+		}
+		dldr.emit(Event{Kind: EventChunkStarted, Range: Chunk{offset, -1}, URL: dldr.urls[u], Attempt: requests})
+		dldr.statsRequest(0, u, 0)
+		total, err := fetch(u)
+		dldr.connBudget.release()
+		if ctx.Err() != nil {
+			dldr.statsDone(0, u, nil)
+		} else {
+			dldr.statsDone(0, u, err)
+		}
+		if err == nil {
+			dldr.emit(Event{Kind: EventChunkCompleted, Range: Chunk{offset - received, offset}, URL: dldr.urls[u],
+				Attempt: requests, Bytes: received, Latency: latency})
+		} else {
+			dldr.emit(Event{Kind: EventChunkFailed, URL: dldr.urls[u], Attempt: requests, Bytes: received,
+				Latency: latency, Err: err})
+		}
+		if err == nil && total >= 0 {
+			dldr.switchToParallel(u, total, offset)
+			return false, nil
+		}
+		if err == nil {
+			dldr.logVerbose("File length: ", offset, " bytes")
+			dldr.fileLength = offset
+			dldr.statsLength(offset)
+			dldr.progressMu.Lock()
+			dldr.chunks = []Chunk{{0, offset}}
+			dldr.current = []int64{offset}
+			dldr.active = []bool{false}
+			dldr.nextPending = 0
+			dldr.progressMu.Unlock()
+			return true, nil
+		}
+		if writeErr != nil {
+			return false, writeErr
+		}
+		if ctx.Err() != nil {
+			return false, &CanceledError{ctx.Err()}
+		}
+		dldr.logVerbose("Download of unknown length failed: ", err)
+		lastErr = err
+
+		decision := failures.failed(ctx, err, offset > before)
+		if ctx.Err() != nil {
+			return false, &CanceledError{ctx.Err()}
+		}
+		if decision == retryStop {
+			break
+		}
+		if decision == retrySkip {
+			skippedUrls[u] = true
+		}
+	}
+	return false, fmt.Errorf("The file couldn't be downloaded from any source. Aborting. Last error: %w", lastErr)
+}
+
+// Internal: set the length learnt from a source supporting ranges, building the chunks
+// table for the rest of the file. Without piece hashes, the data written so far is kept.
+func (dldr *MultiDownloader) switchToParallel(u int, fileLength int64, written int64) {
+	dldr.logVerbose("Source ", dldr.urls[u], " supports ranges, file length: ", fileLength, " bytes")
+	dldr.fileLength = fileLength
+	dldr.statsLength(fileLength)
+	if u < len(dldr.rangeless) {
+		dldr.rangeless[u] = false
+	}
+	dldr.setRanges(u)
+	dldr.progressMu.Lock()
+	defer dldr.progressMu.Unlock()
+	dldr.buildChunks()
+	if dldr.pieceHashes != nil {
+		return
+	}
+	for i, c := range dldr.chunks {
+		if c.Begin < written {
+			dldr.current[i] = c.End
+			if written < c.End {
+				dldr.current[i] = written
+			}
+		}
+	}
+}
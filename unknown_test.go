@@ -0,0 +1,127 @@
+package multipartdownloader
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alvatar/multipart-downloader/internal/testserver"
+)
+
+// Faults of a server of a file without telling its length, in a chunked body. HEAD tells
+// nothing, and so does the probe. Ranges are served after a number of chunked bodies, if
+// not 0.
+func chunkedFaults(chunkedBodies int) testserver.Faults {
+	return testserver.Faults{HeadStatus: http.StatusOK, Chunked: true, ChunkedCount: chunkedBodies}
+}
+
+func TestUnknownLength (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+
+	for _, dropAfter := range []int64{0, 50000} {
+		// The probe and the first download are broken
+		faults := chunkedFaults(0)
+		faults.DropAfter, faults.DropCount = dropAfter, 2
+		server := testserver.New("test", faults)
+		dldr := New([]string{server.FileURL("quijote.txt")}, WithConnections(4), WithRetryPolicy(fastRetryPolicy()))
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+		if dldr.fileLength != -1 || len(dldr.Chunks()) != 0 {
+			t.Fatal("The length should be unknown, got", dldr.fileLength)
+		}
+		_, err = dldr.SetupFile("___unknownFile___")
+		failOnError(t, err)
+
+		var received []int64
+		err = dldr.Download(func(progress []ConnectionProgress) {
+			if len(progress) != 1 || progress[0].End != -1 {
+				t.Fatal("Progress of a file of unknown length should be the bytes received, got", progress)
+			}
+			received = append(received, progress[0].Current)
+		})
+		failOnError(t, err)
+		compareElQuijote(t, dldr.filename)
+		os.Remove(dldr.filename)
+		if _, err := os.Stat(dldr.stateFilename()); !os.IsNotExist(err) {
+			t.Error("No state should be saved for a file of unknown length")
+		}
+		if len(received) == 0 || received[len(received) - 1] != int64(len(reference)) || dldr.fileLength != int64(len(reference)) {
+			t.Error("All bytes should be reported, got", received)
+		}
+		// A broken stream is not mistaken for the end of the file
+		downloads := 0
+		for _, r := range server.Ranges() {
+			if r != "bytes=0-0" {
+				downloads++
+			}
+		}
+		if (dropAfter == 0) != (downloads == 1) {
+			t.Error("With the body broken after", dropAfter, "bytes,", downloads, "bodies were sent")
+		}
+		server.Close()
+	}
+}
+
+// A source telling the length in a partial response is downloaded from in parallel
+func TestUnknownLengthSwitch (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	server := testserver.New("test", chunkedFaults(1))
+	defer server.Close()
+
+	dldr := New([]string{server.FileURL("quijote.txt")}, WithConnections(4))
+	_, err = dldr.GatherInfo()
+	failOnError(t, err)
+	if dldr.fileLength != -1 {
+		t.Fatal("The length should be unknown, got", dldr.fileLength)
+	}
+	_, err = dldr.SetupFile("___unknownFile___")
+	failOnError(t, err)
+	defer os.Remove(dldr.filename)
+	err = dldr.Download(func([]ConnectionProgress) {})
+	failOnError(t, err)
+	compareElQuijote(t, dldr.filename)
+
+	// The probe got the whole file, the download request told the length
+	ranges := server.Ranges()
+	if len(ranges) < 4 || ranges[0] != "bytes=0-0" || ranges[1] != "bytes=0-" {
+		t.Fatal("The file should be downloaded in parallel once the length is known, got requests", ranges)
+	}
+	whole := fmt.Sprintf("bytes=0-%d", len(reference) - 1)
+	chunks := make(map[string]bool)
+	for _, r := range ranges[2:] {
+		if !strings.HasPrefix(r, "bytes=") || strings.HasSuffix(r, "-") || r == whole {
+			t.Error("Chunks should be requested once the length is known, got", r)
+		}
+		chunks[r] = true
+	}
+	if len(chunks) < 2 {
+		t.Error("Several chunks should be requested once the length is known, got", ranges[2:])
+	}
+}
+
+func TestUnknownLengthStream (t *testing.T) {
+	reference, err := ioutil.ReadFile("test/quijote.txt")
+	failOnError(t, err)
+	for _, chunked := range []int{0, 1} {
+		server := testserver.New("test", chunkedFaults(chunked))
+		dldr := New([]string{server.FileURL("quijote.txt")}, WithConnections(4), WithHashes("sha256"),
+			WithStreamBuffer(64 << 10))
+		_, err := dldr.GatherInfo()
+		failOnError(t, err)
+		var out bytes.Buffer
+		failOnError(t, dldr.DownloadTo(&out, nil))
+		if !bytes.Equal(reference, out.Bytes()) {
+			t.Error("Streamed data of unknown length does not match the reference file")
+		}
+		if err := dldr.Verify("sha256", quijoteDigests["sha256"]); err != nil {
+			t.Error(err)
+		}
+		server.Close()
+	}
+}
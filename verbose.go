@@ -18,3 +18,20 @@ func SetVerbose(verb bool) {
 	verbose = verb
 }
 
+// Verbose logging of a downloader, to its own logger if it has one
+func (dldr *MultiDownloader) logVerbose(e ...interface{}) {
+	if dldr.logger != nil {
+		dldr.logger.Print(e...)
+	} else {
+		logVerbose(e...)
+	}
+}
+
+// Error logging of a downloader, regardless of verbosity
+func (dldr *MultiDownloader) logError(e ...interface{}) {
+	if dldr.logger != nil {
+		dldr.logger.Print(e...)
+	} else {
+		log.Print(e...)
+	}
+}